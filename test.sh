@@ -19,4 +19,5 @@ fi
 CGO_LDFLAGS="$libv8_base $libv8_snapshot $librt" \
 CGO_CFLAGS="-I $v8_path/include" \
 CGO_CXXFLAGS="-I $v8_path/include" \
+GODEBUG=cgocheck=2 \
 go test -run="$1" -bench="$2" -v
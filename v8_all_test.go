@@ -1,13 +1,21 @@
 package v8
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,7 +23,6 @@ import (
 var engine = NewEngine()
 
 func init() {
-	// traceDispose = true
 	rand.Seed(time.Now().UnixNano())
 	go func() {
 		for {
@@ -66,11 +73,45 @@ func Test_InternalField(t *testing.T) {
 		cache = append(cache, str1)
 		cs.SetPrivateData(cache)
 		obj := ot.NewObject().ToObject()
+
+		if _, ok := obj.GetInternalField(0); ok {
+			t.Fatal("unset field has a value")
+		}
+
+		if _, ok := obj.GetInternalField(1); ok {
+			t.Fatal("field out of range has a value")
+		}
+
 		obj.SetInternalField(0, str1)
-		str2 := obj.GetInternalField(0).(string)
-		if str1 != str2 {
+		str2, ok := obj.GetInternalField(0)
+		if !ok || str1 != str2.(string) {
 			t.Fatal("data not match")
 		}
+
+		goHandles.RLock()
+		count := len(goHandles.values)
+		goHandles.RUnlock()
+
+		// the old value is released when the field is set again
+		obj.SetInternalField(0, 1)
+		if value, ok := obj.GetInternalField(0); !ok || value.(int) != 1 {
+			t.Fatal("data not replaced")
+		}
+
+		obj.SetAlignedPointerInInternalField(0, nil)
+		if _, ok := obj.GetInternalField(0); ok {
+			t.Fatal("aligned pointer read as Go value")
+		}
+
+		if obj.GetAlignedPointerFromInternalField(0) != nil {
+			t.Fatal("aligned pointer not stored")
+		}
+
+		goHandles.RLock()
+		if len(goHandles.values) != count-1 {
+			t.Error("replaced values not released")
+		}
+		goHandles.RUnlock()
 	})
 	context.SetPrivateData(nil)
 }
@@ -79,78 +120,1708 @@ func Test_GetVersion(t *testing.T) {
 	t.Log(GetVersion())
 }
 
-func Test_Allocator(t *testing.T) {
-	SetArrayBufferAllocator(nil, nil)
-	script := engine.Compile([]byte(`var data = new ArrayBuffer(10); data[0]='a'; data[0];`), nil, nil)
-	engine.NewContext(nil).Scope(func(cs ContextScope) {
-		exception := cs.TryCatch(true, func() {
-			value := script.Run()
-			if value.ToString() != "a" {
-				t.Fatal("value failed")
+func Test_Allocator(t *testing.T) {
+	SetArrayBufferAllocator(nil, nil)
+	script := engine.Compile([]byte(`var data = new ArrayBuffer(10); data[0]='a'; data[0];`), nil, nil)
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		exception := cs.TryCatch(true, func() {
+			value := script.Run()
+			if value.ToString() != "a" {
+				t.Fatal("value failed")
+			}
+		})
+		if exception != "" {
+			t.Fatalf("exception found:%s", exception)
+		}
+	})
+}
+
+func Test_MessageListener(t *testing.T) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		cs.AddMessageListener(true, func(message string, data interface{}) {
+			println("golang", message)
+		}, nil)
+		script := engine.Compile([]byte(`var test[ = ;`), nil, nil)
+		if script != nil {
+			script.Run()
+		}
+
+		SetCaptureStackTraceForUncaughtExceptions(true, 1)
+		cs.AddMessageListener(false, func(message string, data interface{}) {
+			println("golang2", message)
+		}, nil)
+		script = engine.Compile([]byte(`var test] = ;`), nil, nil)
+		if script != nil {
+			script.Run()
+		}
+
+		cs.AddMessageListener(true, nil, nil)
+		exception := cs.TryCatch(true, func() {
+			script = engine.Compile([]byte(`var test[] = ;`), nil, nil)
+			if script != nil {
+				script.Run()
+			}
+		})
+		if exception != "" {
+			println("exception:", exception)
+		}
+	})
+}
+
+func Test_HelloWorld(t *testing.T) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		if cs.Eval("'Hello ' + 'World!'").ToString() != "Hello World!" {
+			t.Fatal("result not match")
+		}
+	})
+
+	runtime.GC()
+}
+
+func Test_TryCatch(t *testing.T) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		cs.TryCatch(true, func() {
+			engine.Compile([]byte("a[=1"), nil, nil)
+		})
+
+		if cs.TryCatch(true, func() {
+			cs.ThrowException("this is error")
+		}) != "this is error" {
+			t.Fatal("error message not match")
+		}
+	})
+
+	runtime.GC()
+}
+
+func Test_ThrowException(t *testing.T) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		message := "it's \"quoted\"\nand multi-line"
+
+		if cs.TryCatch(true, func() {
+			cs.ThrowException(message)
+		}) != message {
+			t.Fatal("error message not match")
+		}
+
+		err := cs.TryCatchError(func() {
+			cs.Throw(cs.NewInteger(42))
+		})
+		if jsErr, ok := err.(*JSError); !ok || jsErr.Value.ToInteger() != 42 {
+			t.Fatal("thrown value not match:", err)
+		}
+
+		// FunctionTemplate::GetFunction() must still work after a throw
+		if cs.TryCatch(true, func() {
+			cs.ThrowError("before GetFunction")
+		}) == "" {
+			t.Fatal("exception not caught")
+		}
+
+		thrower := engine.NewFunctionTemplate(func(info FunctionCallbackInfo) {
+			cs := info.CurrentScope()
+			switch info.Get(0).ToString() {
+			case "Error":
+				cs.ThrowError("error")
+			case "TypeError":
+				cs.ThrowTypeError("type error")
+			case "RangeError":
+				cs.ThrowRangeError("range error")
+			case "SyntaxError":
+				cs.ThrowSyntaxError("syntax error")
+			case "ReferenceError":
+				cs.ThrowReferenceError("reference error")
+			}
+		}, nil).NewFunction()
+
+		if thrower == nil {
+			t.Fatal("GetFunction() returns NULL after ThrowException")
+		}
+
+		cs.Global().SetProperty("thrower", thrower, PA_None)
+
+		for _, name := range []string{"Error", "TypeError", "RangeError", "SyntaxError", "ReferenceError"} {
+			if !cs.Eval(`
+				(function() {
+					try {
+						thrower("` + name + `");
+					} catch (e) {
+						return e instanceof ` + name + ` && typeof e.stack == "string";
+					}
+					return false;
+				})()
+			`).IsTrue() {
+				t.Fatal(name + " not thrown from callback")
+			}
+		}
+
+		err = cs.TryCatchError(func() {
+			cs.Eval(`thrower("TypeError")`)
+		})
+		if jsErr, ok := err.(*JSError); !ok || !strings.Contains(jsErr.Message, "TypeError: type error") {
+			t.Fatal("uncaught callback exception not match:", err)
+		}
+	})
+
+	runtime.GC()
+}
+
+func Test_JSError(t *testing.T) {
+	SetCaptureStackTraceForUncaughtExceptions(true, 10)
+
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		code := "function foo() {\n  throw new Error('oops');\n}\nfoo();"
+
+		var report string
+		err := cs.TryCatchError(func() {
+			report = cs.TryCatch(false, func() {
+				engine.Compile([]byte(code), nil, nil).Run()
+			})
+			engine.Compile([]byte(code), nil, nil).Run()
+		})
+
+		jsErr, ok := err.(*JSError)
+		if !ok {
+			t.Fatal("error is not a *JSError:", err)
+		}
+
+		if jsErr.Error() != report {
+			t.Fatal("error report not match:", jsErr.Error())
+		}
+
+		if !jsErr.Value.IsNativeError() {
+			t.Fatal("exception value is not an Error")
+		}
+
+		if !strings.Contains(jsErr.Message, "oops") {
+			t.Fatal("message not match:", jsErr.Message)
+		}
+
+		if jsErr.LineNumber != 2 || jsErr.SourceLine != "  throw new Error('oops');" {
+			t.Fatal("location not match:", jsErr.LineNumber, jsErr.SourceLine)
+		}
+
+		if jsErr.StartColumn >= jsErr.EndColumn {
+			t.Fatal("columns not match:", jsErr.StartColumn, jsErr.EndColumn)
+		}
+
+		if len(jsErr.StackTrace) < 2 || jsErr.StackTrace[0].Function != "foo" || jsErr.StackTrace[0].Line != 2 {
+			t.Fatal("stack trace not match:", jsErr.StackTrace)
+		}
+
+		if err := cs.TryCatchError(func() { cs.Eval("1+1") }); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	})
+
+	runtime.GC()
+}
+
+func Test_ErrorReturning(t *testing.T) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		script, err := engine.CompileE([]byte("var a = ;"), nil, nil)
+		if script != nil || err == nil {
+			t.Fatal("syntax error not returned")
+		}
+		if jsErr, ok := err.(*JSError); !ok || jsErr.LineNumber != 1 {
+			t.Fatal("syntax error not match:", err)
+		}
+
+		script, err = engine.CompileE([]byte("throw new TypeError('bad')"), nil, nil)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err := script.RunE(); err == nil || !strings.Contains(err.(*JSError).Message, "bad") {
+			t.Fatal("run error not match:", err)
+		}
+
+		value, err := cs.EvalE("1 + 2")
+		if err != nil || value.ToInteger() != 3 {
+			t.Fatal("eval result not match:", value, err)
+		}
+
+		if _, err := cs.EvalE("undefinedFunction()"); err == nil {
+			t.Fatal("eval error not returned")
+		}
+
+		fn := cs.Eval("(function(a) { if (a) throw new Error('arg'); return 1; })").ToFunction()
+
+		if value, err := fn.CallE(engine.False()); err != nil || value.ToInteger() != 1 {
+			t.Fatal("call result not match:", value, err)
+		}
+
+		if _, err := fn.CallE(engine.True()); err == nil || !strings.Contains(err.(*JSError).Message, "arg") {
+			t.Fatal("call error not match:", err)
+		}
+
+		// the plain variants still leave the exception to the outer try catch
+		if err := cs.TryCatchError(func() { fn.Call(engine.True()) }); err == nil {
+			t.Fatal("exception not propagated")
+		}
+	})
+}
+
+func Test_ExecutionTimeout(t *testing.T) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := cs.EvalContext(ctx, "while(true) {}")
+		if !errors.Is(err, ErrTerminated) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("timeout error not match:", err)
+		}
+
+		// the engine must be reusable after a termination
+		if value, err := cs.EvalContext(context.Background(), "1 + 1"); err != nil || value.ToInteger() != 2 {
+			t.Fatal("engine not reusable:", value, err)
+		}
+
+		fn := cs.Eval("(function() { for (;;) {} })").ToFunction()
+
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		_, err = fn.CallContext(ctx)
+		if !errors.Is(err, ErrTerminated) || !errors.Is(err, context.Canceled) {
+			t.Fatal("cancel error not match:", err)
+		}
+
+		// an already cancelled context doesn't run anything
+		if _, err := fn.CallContext(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatal("cancelled context not match:", err)
+		}
+
+		// ordinary exceptions are still reported as *JSError
+		if _, err := cs.EvalContext(context.Background(), "throw 1"); err == nil || errors.Is(err, ErrTerminated) {
+			t.Fatal("exception not match:", err)
+		}
+
+		if cs.Eval("2 + 2").ToInteger() != 4 {
+			t.Fatal("engine not reusable")
+		}
+	})
+}
+
+func Test_ResourceConstraints(t *testing.T) {
+	// V8 takes the limits as int, they must not be truncated
+	if huge := int(^uint(0) >> 1); huge > math.MaxInt32 {
+		func() {
+			defer func() {
+				if r := recover(); r != "v8: EngineOptions.MaxOldSpace is out of range" {
+					t.Fatal("oversized limit accepted:", r)
+				}
+			}()
+			NewEngineWithOptions(EngineOptions{MaxOldSpace: huge})
+		}()
+	}
+
+	hookCalled := false
+
+	limited := NewEngineWithOptions(EngineOptions{
+		MaxOldSpace: 32 << 20,
+		StackLimit:  256 << 10,
+		NearHeapLimit: func(used, limit int) bool {
+			hookCalled = true
+			return used > 0 && limit > 0
+		},
+	})
+
+	limited.NewContext(nil).Scope(func(cs ContextScope) {
+		_, err := cs.EvalE("var a = []; while (true) { a.push({ s: 'x' + a.length }); }")
+		if err != ErrOutOfMemory || !hookCalled {
+			t.Fatal("out of memory not reported:", err, hookCalled)
+		}
+
+		// the engine must be reusable after the termination
+		if value, err := cs.EvalE("a = null; 1 + 1"); err != nil || value.ToInteger() != 2 {
+			t.Fatal("engine not reusable:", value, err)
+		}
+
+		_, err = cs.EvalE("(function f(n) { return f(n + 1) + 1; })(0)")
+		if jsErr, ok := err.(*JSError); !ok || !strings.Contains(jsErr.Message, "RangeError") {
+			t.Fatal("stack overflow not reported:", err)
+		}
+	})
+
+	runtime.GC()
+}
+
+func Test_HeapStatistics(t *testing.T) {
+	stats := engine.HeapStatistics()
+
+	if stats.TotalHeapSize <= 0 || stats.UsedHeapSize <= 0 || stats.HeapSizeLimit < stats.TotalHeapSize {
+		t.Fatal("heap statistics not match:", stats)
+	}
+
+	// must not block while another goroutine holds the locker
+	done := make(chan HeapStatistics)
+
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		go func() {
+			done <- engine.HeapStatistics()
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("HeapStatistics blocked by the locker")
+		}
+	})
+
+	if _, err := engine.HeapSpaceStatistics(); err != ErrNotSupported {
+		t.Fatal("HeapSpaceStatistics error not match:", err)
+	}
+}
+
+// Minimal protocol buffer decoder, the fields of a message by number.
+type protoFields map[int][]protoField
+
+type protoField struct {
+	varint uint64
+	bytes  []byte
+}
+
+func decodeProto(data []byte) (protoFields, error) {
+	fields := make(protoFields)
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("bad field key")
+		}
+		data = data[n:]
+
+		var field protoField
+		switch key & 7 {
+		case 0:
+			if field.varint, n = binary.Uvarint(data); n <= 0 {
+				return nil, errors.New("bad varint")
+			}
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, errors.New("bad length")
+			}
+			field.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return nil, errors.New("unexpected wire type")
+		}
+
+		fields[int(key>>3)] = append(fields[int(key>>3)], field)
+	}
+
+	return fields, nil
+}
+
+func (fields protoFields) varint(number int) uint64 {
+	if values := fields[number]; len(values) > 0 {
+		return values[0].varint
+	}
+	return 0
+}
+
+func (fields protoFields) message(number int) protoFields {
+	if values := fields[number]; len(values) > 0 {
+		message, _ := decodeProto(values[0].bytes)
+		return message
+	}
+	return protoFields{}
+}
+
+func (field protoField) packed() []uint64 {
+	var values []uint64
+	for data := field.bytes; len(data) > 0; {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil
+		}
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values
+}
+
+// Decodes the profile.proto written by WritePprof and checks its
+// tables against the profile.
+//
+func checkPprof(t *testing.T, data []byte, profile *CPUProfile, busy *CPUProfileNode) {
+	message, err := decodeProto(data)
+	if err != nil {
+		t.Fatal("pprof profile not decoded:", err)
+	}
+
+	var strs []string
+	for _, field := range message[pprofProfileStringTable] {
+		strs = append(strs, string(field.bytes))
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatal("pprof string table must start with the empty string")
+	}
+	str := func(index uint64) string {
+		if index >= uint64(len(strs)) {
+			t.Fatal("pprof string index out of range:", index)
+		}
+		return strs[index]
+	}
+
+	var sampleTypes []string
+	for _, field := range message[pprofProfileSampleType] {
+		valueType, _ := decodeProto(field.bytes)
+		sampleTypes = append(sampleTypes, str(valueType.varint(pprofValueTypeType))+"/"+str(valueType.varint(pprofValueTypeUnit)))
+	}
+	if strings.Join(sampleTypes, ",") != "samples/count,cpu/nanoseconds" {
+		t.Fatal("pprof sample types not match:", sampleTypes)
+	}
+
+	period := int64(message.varint(pprofProfilePeriod))
+	if period <= 0 || str(message.message(pprofProfilePeriodType).varint(pprofValueTypeType)) != "cpu" {
+		t.Fatal("pprof period not match:", period)
+	}
+
+	functions := make(map[uint64]string)
+	var busyId uint64
+	for _, field := range message[pprofProfileFunction] {
+		function, _ := decodeProto(field.bytes)
+		id := function.varint(pprofFunctionId)
+		name := str(function.varint(pprofFunctionName))
+		if id == 0 || functions[id] != "" {
+			t.Fatal("pprof function id not unique:", id)
+		}
+		functions[id] = name
+		if name == "busy" {
+			busyId = id
+			if function.varint(pprofFunctionStartLine) != uint64(busy.LineNumber) {
+				t.Fatal("pprof busy function line not match")
+			}
+		}
+	}
+	if busyId == 0 {
+		t.Fatal("pprof busy function missing")
+	}
+
+	locations := make(map[uint64]uint64)
+	for _, field := range message[pprofProfileLocation] {
+		location, _ := decodeProto(field.bytes)
+		functionId := location.message(pprofLocationLine).varint(pprofLineFunctionId)
+		if functions[functionId] == "" {
+			t.Fatal("pprof location of unknown function:", functionId)
+		}
+		locations[location.varint(pprofLocationId)] = functionId
+	}
+
+	var hits, busyHits int64
+	for _, field := range message[pprofProfileSample] {
+		sample, _ := decodeProto(field.bytes)
+
+		var stack []uint64
+		for _, ids := range sample[pprofSampleLocationId] {
+			stack = append(stack, ids.packed()...)
+		}
+		if len(stack) == 0 {
+			t.Fatal("pprof sample without stack")
+		}
+		for _, id := range stack {
+			if locations[id] == 0 {
+				t.Fatal("pprof sample of unknown location:", id)
+			}
+		}
+
+		var values []uint64
+		for _, field := range sample[pprofSampleValue] {
+			values = append(values, field.packed()...)
+		}
+		if len(values) != 2 || int64(values[1]) != int64(values[0])*period {
+			t.Fatal("pprof sample values not match:", values)
+		}
+
+		hits += int64(values[0])
+		if locations[stack[0]] == busyId {
+			busyHits += int64(values[0])
+		}
+	}
+
+	// samples of nodes of the same function share its location
+	if hits != int64(profile.Root.TotalHitCount-profile.Root.HitCount) || busyHits < int64(busy.HitCount) {
+		t.Fatal("pprof sample hits not match:", hits, busyHits)
+	}
+}
+
+func Test_CPUProfile(t *testing.T) {
+	engine.StartCPUProfile("test")
+
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		cs.Eval(`
+		function busy() {
+			var n = 0;
+			for (var start = Date.now(); Date.now() - start < 200;) { n++; }
+			return n;
+		}
+		busy();`)
+	})
+
+	profile := engine.StopCPUProfile("test")
+
+	if profile == nil || profile.Title != "test" || profile.Root == nil {
+		t.Fatal("profile not collected")
+	}
+
+	if engine.StopCPUProfile("test") != nil {
+		t.Fatal("profile stopped twice")
+	}
+
+	var find func(node *CPUProfileNode) *CPUProfileNode
+	find = func(node *CPUProfileNode) *CPUProfileNode {
+		if node.FunctionName == "busy" {
+			return node
+		}
+		for _, child := range node.Children {
+			if found := find(child); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+
+	busy := find(profile.Root)
+	if busy == nil || busy.LineNumber != 2 || busy.TotalHitCount < busy.HitCount || profile.Root.TotalHitCount < busy.TotalHitCount {
+		t.Fatal("busy function not profiled:", busy)
+	}
+
+	var buf bytes.Buffer
+	if err := profile.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(gz)
+	checkPprof(t, data, profile, busy)
+
+	buf.Reset()
+	if err := profile.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var chrome struct {
+		Nodes []struct {
+			Id        int
+			CallFrame struct{ FunctionName string }
+			Children  []int
+		}
+		Samples []int
+	}
+	if err := json.Unmarshal(buf.Bytes(), &chrome); err != nil || len(chrome.Nodes) == 0 || len(chrome.Samples) != len(profile.Samples) {
+		t.Fatal("chrome profile not match:", err)
+	}
+}
+
+func Test_HeapSnapshot(t *testing.T) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		cs.Eval(`
+		function Leaky() { this.self = this; }
+		var leaks = [];
+		for (var i = 0; i < 100; i++) { leaks.push(new Leaky()); }`)
+
+		var buf bytes.Buffer
+		if err := engine.TakeHeapSnapshot(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		snapshot, err := ParseHeapSnapshot(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count := snapshot.ObjectCounts()["Leaky"]; count != 100 {
+			t.Fatal("object count not match:", count)
+		}
+
+		for _, node := range snapshot.Nodes {
+			if node.Name != "Leaky" || node.Type != "object" {
+				continue
+			}
+			selfRef := false
+			for _, edge := range node.Edges {
+				if edge.Name == "self" && edge.To.Id == node.Id && edge.From.Id == node.Id {
+					selfRef = true
+				}
+			}
+			if !selfRef {
+				t.Fatal("edge not found")
+			}
+		}
+
+		if _, err := ParseHeapSnapshot(strings.NewReader(`{"snapshot":{}}`)); err == nil {
+			t.Fatal("invalid snapshot accepted")
+		}
+	})
+}
+
+func Test_CallbackPanic(t *testing.T) {
+	var handled []interface{}
+
+	panicEngine := NewEngine()
+	panicEngine.SetPanicHandler(func(value interface{}, stack []byte) {
+		if len(stack) == 0 {
+			t.Fatal("panic stack is empty")
+		}
+		handled = append(handled, value)
+	})
+
+	panicEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		function := panicEngine.NewFunctionTemplate(func(info FunctionCallbackInfo) {
+			panic("function panic")
+		}, nil).NewFunction()
+
+		template := panicEngine.NewObjectTemplate()
+		template.SetAccessor("prop", func(name string, info AccessorCallbackInfo) {
+			panic("getter panic")
+		}, nil, nil, PA_None)
+
+		cs.Global().SetProperty("panicker", function, PA_None)
+		cs.Global().SetProperty("object", template.NewObject(), PA_None)
+
+		result := cs.Eval(`
+		(function() {
+			var messages = [];
+			try { panicker(); } catch (e) {
+				if (!(e instanceof Error) || e.goStack.indexOf("Test_CallbackPanic") < 0) return "";
+				messages.push(e.goPanic);
+			}
+			try { object.prop; } catch (e) { messages.push(e.goPanic); }
+			return messages.join(",");
+		})()`)
+
+		if result.ToString() != "function panic,getter panic" {
+			t.Fatal("panic not thrown into JavaScript:", result.ToString())
+		}
+
+		// the engine must stay usable after the recovered panics
+		if cs.Eval("1 + 1").ToInteger() != 2 {
+			t.Fatal("engine not usable")
+		}
+	})
+
+	if len(handled) != 2 || handled[0] != "function panic" {
+		t.Fatal("panic handler not called:", handled)
+	}
+
+	// panics of scope callbacks still reach Go, with the isolate unlocked
+	func() {
+		defer func() {
+			if r := recover(); r != "scope panic" {
+				t.Fatal("scope panic not re-panicked:", r)
+			}
+		}()
+		panicEngine.NewContext(nil).Scope(func(cs ContextScope) {
+			panic("scope panic")
+		})
+	}()
+
+	done := make(chan bool)
+	go func() {
+		panicEngine.NewContext(nil).Scope(func(cs ContextScope) {
+			done <- cs.Eval("true").IsTrue()
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("isolate still locked after a scope panic")
+	}
+}
+
+type panicWriter struct{}
+
+func (panicWriter) Write(p []byte) (int, error) {
+	panic("writer panic")
+}
+
+func Test_GlobalCallbackPanic(t *testing.T) {
+	var handled []interface{}
+
+	panicEngine := NewEngine()
+	defer panicEngine.Dispose()
+
+	panicEngine.SetPanicHandler(func(value interface{}, stack []byte) {
+		handled = append(handled, value)
+	})
+
+	panicEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		cs.AddMessageListener(true, func(message string, data interface{}) {
+			panic("listener panic")
+		}, nil)
+		defer cs.AddMessageListener(true, nil, nil)
+
+		// an uncaught syntax error is reported to the listeners
+		panicEngine.Compile([]byte(`var test[ = ;`), nil, nil)
+
+		if cs.Eval("1 + 1").ToInteger() != 2 {
+			t.Fatal("engine not usable")
+		}
+	})
+
+	if err := panicEngine.TakeHeapSnapshot(panicWriter{}); err == nil || !strings.Contains(err.Error(), "writer panic") {
+		t.Fatal("writer panic not returned:", err)
+	}
+
+	if len(handled) != 2 || handled[0] != "listener panic" || handled[1] != "writer panic" {
+		t.Fatal("panics not reported:", handled)
+	}
+}
+
+func Test_APIMisuse(t *testing.T) {
+	var fatal []string
+	SetFatalErrorHandler(func(location, message string) {
+		fatal = append(fatal, location+": "+message)
+	})
+	defer SetFatalErrorHandler(nil)
+
+	script := engine.Compile([]byte("1 + 1"), nil, nil)
+
+	func() {
+		defer func() {
+			if r := recover(); r != "Please call this API in a context scope" {
+				t.Fatal("misuse not reported:", r)
+			}
+		}()
+		script.Run()
+	}()
+
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		// the isolate must not be left locked by the misuse above
+		if script.Run().ToInteger() != 2 {
+			t.Fatal("engine not usable")
+		}
+	})
+
+	if engine.IsDead() || len(fatal) != 0 {
+		t.Fatal("engine marked dead:", fatal)
+	}
+}
+
+func Test_EngineDispose(t *testing.T) {
+	var report LeakReport
+	disposeEngine := NewEngineWithOptions(EngineOptions{
+		LeakReport: func(r LeakReport) {
+			report = r
+		},
+	})
+
+	script := disposeEngine.Compile([]byte("({a: 1})"), nil, nil)
+	context := disposeEngine.NewContext(nil)
+
+	var value *Value
+	context.Scope(func(cs ContextScope) {
+		value = script.Run()
+	})
+
+	disposeEngine.Dispose()
+
+	if report.Values < 1 || report.Scripts < 1 || report.Contexts < 1 {
+		t.Fatal("leaks not reported:", report)
+	}
+
+	mustPanic := func(name string, callback func()) {
+		defer func() {
+			if r := recover(); r != "v8: engine is disposed" {
+				t.Fatal(name, "used after dispose:", r)
+			}
+		}()
+		callback()
+	}
+
+	mustPanic("value", func() { value.IsObject() })
+	mustPanic("script", func() { script.Run() })
+	mustPanic("context", func() { context.Scope(func(ContextScope) {}) })
+	mustPanic("engine", func() { disposeEngine.NewContext(nil) })
+
+	// a second dispose is a no-op
+	disposeEngine.Dispose()
+
+	// the finalizers must not free the disposed handles again
+	value, script, context = nil, nil, nil
+	runtime.GC()
+}
+
+func Test_HandleScope(t *testing.T) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		var released, escaped, nested *Value
+
+		cs.HandleScope(func(hs HandleScope) {
+			released = hs.NewString("released")
+			escaped = hs.NewString("escaped").Escape()
+
+			hs.HandleScope(func(inner HandleScope) {
+				nested = inner.NewInteger(42).Escape()
+			})
+
+			if nested.ToInteger() != 42 {
+				t.Fatal("value not escaped to the outer handle scope")
+			}
+		})
+
+		if escaped.ToString() != "escaped" {
+			t.Fatal("escaped value lost")
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r != "v8: value used after its handle scope ended" {
+					t.Fatal("released value still usable:", r)
+				}
+			}()
+			released.ToString()
+		}()
+
+		func() {
+			defer func() {
+				if r := recover(); r != "v8: value used after its handle scope ended" {
+					t.Fatal("nested value outlived the outer handle scope:", r)
+				}
+			}()
+			nested.ToInteger()
+		}()
+
+		// cached constants never belong to a handle scope
+		cs.HandleScope(func(hs HandleScope) {
+			hs.NewBoolean(true)
+		})
+		if !cs.NewBoolean(true).IsTrue() {
+			t.Fatal("constant released by a handle scope")
+		}
+	})
+}
+
+func Test_DisposalQueue(t *testing.T) {
+	queueEngine := NewEngine()
+	defer queueEngine.Dispose()
+
+	// garbage for the finalizers, made before the engine gets busy
+	func() {
+		queueEngine.Compile([]byte("1"), nil, nil)
+		queueEngine.NewContext(nil)
+	}()
+
+	running := make(chan bool)
+	finished := make(chan bool)
+
+	go queueEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		running <- true
+		cs.EvalContext(ctx, "while(true) {}")
+		finished <- true
+	})
+
+	<-running
+
+	// the finalizers must queue the handles while the script still
+	// holds the engine
+	queued := false
+	for i := 0; i < 50 && !queued; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		queued = atomic.LoadInt32(&queueEngine.queued) != 0
+	}
+
+	if !queued {
+		t.Fatal("finalizers blocked by a running script")
+	}
+
+	<-finished
+
+	queueEngine.CollectGarbageHandles()
+
+	if len(queueEngine.queuedScripts) != 0 || len(queueEngine.queuedContexts) != 0 {
+		t.Fatal("queued handles not freed")
+	}
+}
+
+func Test_WeakCallback(t *testing.T) {
+	type wrapped struct {
+		name string
+	}
+
+	weakEngine := NewEngine()
+	defer weakEngine.Dispose()
+
+	template := weakEngine.NewObjectTemplate()
+	template.SetInternalFieldCount(1)
+
+	collected := 0
+	var last *Object
+
+	weakEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		// the handle scope releases the locals, so only the weak
+		// handles are left
+		cs.HandleScope(func(hs HandleScope) {
+			for i := 0; i < 100; i++ {
+				object := template.NewWrapped(&wrapped{"wrapped"})
+				if value, _ := object.GetInternalField(0); value.(*wrapped).name != "wrapped" {
+					t.Fatal("wrapped value not stored")
+				}
+				object.SetWeak(func(object *Object) {
+					collected += 1
+					last = object
+				})
+			}
+		})
+	})
+
+	weakEngine.LowMemoryNotification()
+
+	if collected != 100 {
+		t.Fatal("weak callbacks not called:", collected)
+	}
+
+	weakEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		defer func() {
+			if r := recover(); r != "v8: value used after its handle scope ended" {
+				t.Fatal("weak callback object usable after the callback:", r)
+			}
+		}()
+		last.InternalFieldCount()
+	})
+
+	weakMutex.Lock()
+	for _, ref := range weakRefs {
+		if ref.engine == weakEngine {
+			t.Error("wrapped value not dropped")
+			break
+		}
+	}
+	weakMutex.Unlock()
+}
+
+func Test_GoHandles(t *testing.T) {
+	countHandles := func() int {
+		goHandles.RLock()
+		defer goHandles.RUnlock()
+		return len(goHandles.values)
+	}
+
+	start := countHandles()
+
+	handleEngine := NewEngine()
+
+	function := handleEngine.NewFunctionTemplate(func(info FunctionCallbackInfo) {
+		info.ReturnValue().SetString(info.Data().(string))
+	}, "function data").NewFunction()
+
+	template := handleEngine.NewObjectTemplate()
+	template.SetInternalFieldCount(1)
+	template.SetAccessor("prop", func(name string, info AccessorCallbackInfo) {
+		info.ReturnValue().SetString(name + " " + info.Data().(string))
+	}, nil, "accessor data", PA_None)
+
+	handleEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		cs.HandleScope(func(hs HandleScope) {
+			object := template.NewWrapped("wrapped")
+
+			cs.Global().SetProperty("f", function, PA_None)
+			cs.Global().SetProperty("o", object.Value, PA_None)
+
+			cs.TryCatch(true, func() {
+				if result := cs.Eval("f() + ',' + o.prop"); result.ToString() != "function data,prop accessor data" {
+					t.Fatal("callback data not passed:", result.ToString())
+				}
+			})
+
+			if value, _ := object.GetInternalField(0); value != "wrapped" {
+				t.Fatal("internal field not stored")
+			}
+
+			wrapStart := countHandles()
+			for i := 0; i < 10; i++ {
+				template.WrapObject(cs.NewObject())
+			}
+			if count := countHandles(); count != wrapStart {
+				t.Fatal("WrapObject registered handles:", count-wrapStart)
+			}
+		})
+	})
+
+	disposeStart := countHandles()
+	template.Dispose()
+	if count := countHandles(); count != disposeStart-1 {
+		t.Fatal("template Dispose didn't release its accessor:", disposeStart-count)
+	}
+
+	var buf bytes.Buffer
+	if err := handleEngine.TakeHeapSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	handleEngine.Dispose()
+
+	if count := countHandles(); count != start {
+		t.Fatal("Go handles not released:", count-start)
+	}
+}
+
+func Test_ContextEnter(t *testing.T) {
+	enterEngine := NewEngine()
+
+	mustPanic := func(message string, callback func()) {
+		defer func() {
+			if r := recover(); r != message {
+				t.Fatal("expected panic", message, "got:", r)
+			}
+		}()
+		callback()
+	}
+
+	outer := enterEngine.NewContext(nil)
+	inner := enterEngine.NewContext(nil)
+
+	cs, err := outer.Enter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := cs.Eval("var a = 1; a + 1")
+
+	innerScope, err := inner.Enter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if innerScope.Eval("typeof a").ToString() != "undefined" {
+		t.Fatal("inner context sees the outer global")
+	}
+
+	mustPanic("v8: context scopes must be exited in reverse order", cs.Exit)
+
+	exited := make(chan interface{})
+	go func() {
+		defer func() { exited <- recover() }()
+		innerScope.Exit()
+	}()
+	if r := <-exited; r != "v8: context scope exited by another goroutine" {
+		t.Fatal("scope exited by another goroutine:", r)
+	}
+
+	innerScope.Exit()
+	mustPanic("v8: context scope already exited", innerScope.Exit)
+
+	// still valid, the outer scope is open
+	if value.ToInteger() != 2 {
+		t.Fatal("value lost by the inner scope")
+	}
+
+	cs.Exit()
+
+	mustPanic("v8: value used outside of its context scope", func() { value.ToInteger() })
+
+	// values can't be carried into a later scope either
+	outer.Scope(func(cs ContextScope) {
+		mustPanic("v8: value used outside of its context scope", func() { value.ToInteger() })
+	})
+
+	// nor can context scopes, even while another scope is open
+	var saved ContextScope
+	outer.Scope(func(cs ContextScope) { saved = cs })
+	inner.Scope(func(ContextScope) {
+		mustPanic("v8: context scope used outside of its scope", func() { saved.Global() })
+	})
+
+	// a Scope callback exits what it left open
+	mustPanic("v8: context scope opened by Enter was not exited", func() {
+		outer.Scope(func(ContextScope) {
+			inner.Enter()
+		})
+	})
+
+	cs, err = outer.Enter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Eval("a").ToInteger() != 1 {
+		t.Fatal("context state lost")
+	}
+	cs.Exit()
+
+	scopeErr := errors.New("scope error")
+	if err := outer.ScopeE(func(ContextScope) error { return scopeErr }); err != scopeErr {
+		t.Fatal("callback error not returned:", err)
+	}
+
+	enterEngine.Dispose()
+
+	if err := outer.ScopeE(func(ContextScope) error { return nil }); err != ErrEngineDisposed {
+		t.Fatal("disposed engine not reported:", err)
+	}
+
+	if _, err := outer.Enter(); err != ErrEngineDisposed {
+		t.Fatal("disposed engine not reported:", err)
+	}
+}
+
+func Test_EngineMismatch(t *testing.T) {
+	otherEngine := NewEngine()
+	defer otherEngine.Dispose()
+
+	mustPanic := func(message string, callback func()) {
+		defer func() {
+			if r := recover(); r != message {
+				t.Fatal("expected panic", message, "got:", r)
+			}
+		}()
+		callback()
+	}
+
+	var other *Value
+	otherEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		engine.NewContext(nil).Scope(func(mine ContextScope) {
+			other = cs.NewString("other")
+
+			object := mine.NewObject().ToObject()
+			mustPanic("v8: value belongs to another engine", func() {
+				object.SetProperty("other", other, PA_None)
+			})
+			mustPanic("v8: value belongs to another engine", func() {
+				object.SetElement(0, other)
+			})
+			mustPanic("v8: value belongs to another engine", func() {
+				mine.Eval("(function() {})").ToFunction().Call(other)
+			})
+			mustPanic("v8: value belongs to another engine", func() {
+				mine.Throw(other)
+			})
+
+			if _, err := mine.NewValue([]interface{}{other}); err != ErrEngineMismatch {
+				t.Fatal("mismatch not returned by NewValue:", err)
+			}
+
+			if value, err := mine.NewValue([]interface{}{mine.NewString("mine")}); err != nil || value == nil {
+				t.Fatal("own value not passed:", err)
+			}
+		})
+	})
+
+	mustPanic("v8: object template belongs to another engine", func() {
+		engine.NewContext(otherEngine.NewObjectTemplate())
+	})
+
+	mustPanic("v8: script origin belongs to another engine", func() {
+		engine.Compile([]byte("1"), otherEngine.NewScriptOrigin("other.js", 0, 0), nil)
+	})
+}
+
+func Test_Executor(t *testing.T) {
+	executorEngine := NewEngine()
+	defer executorEngine.Dispose()
+
+	executor := executorEngine.Executor()
+	if executorEngine.Executor() != executor {
+		t.Fatal("executor not reused")
+	}
+
+	executor.Do(func(cs ContextScope) {
+		cs.Eval("var count = 0")
+	})
+
+	results := make([]<-chan Result, 0, 100)
+	for i := 0; i < 100; i++ {
+		results = append(results, executor.Go(func(cs ContextScope) {
+			cs.Eval("count++")
+		}))
+	}
+
+	for _, result := range results {
+		if err := (<-result).Err; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int64
+	executor.Do(func(cs ContextScope) {
+		count = cs.Eval("count").ToInteger()
+	})
+	if count != 100 {
+		t.Fatal("executor work lost:", count)
+	}
+
+	// the work shares the scope the executor keeps open, but not its
+	// values
+	var first ContextScope
+	var value *Value
+	executor.Do(func(cs ContextScope) {
+		first, value = cs, cs.NewObject()
+	})
+	executor.Do(func(cs ContextScope) {
+		if cs.entered == nil || cs.entered != first.entered {
+			t.Error("executor scope not kept open")
+		}
+		defer func() {
+			if r := recover(); r != "v8: value used after its handle scope ended" {
+				t.Error("value of earlier work usable:", r)
+			}
+		}()
+		value.IsObject()
+	})
+
+	// the idle executor doesn't hold the isolate
+	done := make(chan bool)
+	go func() {
+		executorEngine.NewContext(nil).Scope(func(ContextScope) {})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle executor holds the isolate")
+	}
+
+	// work submitting work must not wait for itself
+	var queued <-chan Result
+	executor.Do(func(cs ContextScope) {
+		executor.Do(func(cs ContextScope) {
+			count = cs.Eval("++count").ToInteger()
+		})
+		queued = executor.Go(func(cs ContextScope) {
+			cs.Eval("count++")
+		})
+	})
+	if err := (<-queued).Err; err != nil || count != 101 {
+		t.Fatal("re-entrant work failed:", count, err)
+	}
+
+	if err, ok := (<-executor.Go(func(ContextScope) { panic("work panic") })).Err.(*PanicError); !ok || err.Value != "work panic" {
+		t.Fatal("panic not returned:", err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "work panic" {
+				t.Fatal("panic not raised by Do:", r)
+			}
+		}()
+		executor.Do(func(ContextScope) { panic("work panic") })
+	}()
+
+	executor.Close()
+
+	if err := executor.Do(func(ContextScope) {}); err != ErrExecutorClosed {
+		t.Fatal("closed executor ran work:", err)
+	}
+
+	if executorEngine.Executor() == executor {
+		t.Fatal("closed executor reused")
+	}
+}
+
+func Test_Unlocked(t *testing.T) {
+	unlockEngine := NewEngine()
+	defer unlockEngine.Dispose()
+
+	panicOf := func(callback func()) (value interface{}) {
+		defer func() { value = recover() }()
+		callback()
+		return nil
+	}
+
+	unlocked := make(chan bool)
+	release := make(chan bool)
+
+	function := unlockEngine.NewFunctionTemplate(func(info FunctionCallbackInfo) {
+		arg := info.Get(0)
+		info.Unlocked(func() {
+			if r := panicOf(func() { arg.ToString() }); r != "v8: value used inside Unlocked" {
+				t.Error("value usable inside Unlocked:", r)
+			}
+			if r := panicOf(func() { info.Length() }); r != "v8: callback info used inside Unlocked" {
+				t.Error("callback info usable inside Unlocked:", r)
+			}
+			unlocked <- true
+			<-release
+		})
+		info.ReturnValue().SetString(arg.ToString() + " done")
+	}, nil).NewFunction()
+
+	// runs while the callback waits with the engine unlocked
+	go func() {
+		<-unlocked
+		unlockEngine.NewContext(nil).Scope(func(cs ContextScope) {
+			if cs.Eval("1 + 1").ToInteger() != 2 {
+				t.Error("engine not usable while unlocked")
+			}
+		})
+		release <- true
+	}()
+
+	unlockEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		cs.Global().SetProperty("wait", function, PA_None)
+		if result := cs.Eval("wait('work')"); result.ToString() != "work done" {
+			t.Fatal("callback not resumed:", result.ToString())
+		}
+	})
+
+	panicking := unlockEngine.NewFunctionTemplate(func(info FunctionCallbackInfo) {
+		info.Unlocked(func() { panic("unlocked panic") })
+	}, nil).NewFunction()
+
+	unlockEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		cs.Global().SetProperty("panicking", panicking, PA_None)
+		result := cs.Eval("try { panicking() } catch (e) { e.goPanic }")
+		if result.ToString() != "unlocked panic" {
+			t.Fatal("panic not thrown into JavaScript:", result.ToString())
+		}
+	})
+}
+
+func Test_Pool(t *testing.T) {
+	setupErr := errors.New("setup error")
+	if _, err := NewPool(PoolOptions{Size: 1, Setup: func(e *Engine) (*Context, error) {
+		return nil, setupErr
+	}}); err != setupErr {
+		t.Fatal("setup error not returned:", err)
+	}
+
+	pool, err := NewPool(PoolOptions{
+		Size:    2,
+		MaxUses: 3,
+		Setup: func(e *Engine) (*Context, error) {
+			c := e.NewContext(nil)
+			return c, c.ScopeE(func(cs ContextScope) error {
+				_, err := cs.EvalE("var greeting = 'hello'")
+				return err
+			})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	use := func() {
+		pe, err := pool.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pe.Context.Scope(func(cs ContextScope) {
+			if cs.Eval("greeting").ToString() != "hello" {
+				t.Fatal("engine not set up")
+			}
+		})
+		pool.Release(pe)
+	}
+
+	for i := 0; i < 10; i++ {
+		use()
+	}
+
+	first, _ := pool.Acquire(context.Background())
+	second, _ := pool.Acquire(context.Background())
+
+	if stats := pool.Stats(); stats.InUse != 2 || stats.Idle != 0 {
+		t.Fatal("wrong stats:", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatal("acquire of a busy pool not timed out:", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.Release(first)
+	}()
+
+	third, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Release(second)
+	pool.Release(third)
+
+	func() {
+		defer func() {
+			if r := recover(); r != "v8: pooled engine released twice" {
+				t.Fatal("double release accepted:", r)
+			}
+		}()
+		pool.Release(third)
+	}()
+
+	stats := pool.Stats()
+	if stats.Acquires != 13 || stats.Recycled < 1 || stats.MaxWait < 10*time.Millisecond {
+		t.Fatal("wrong stats:", stats)
+	}
+
+	pool.Close()
+
+	if _, err := pool.Acquire(context.Background()); err != ErrPoolClosed {
+		t.Fatal("closed pool handed out an engine:", err)
+	}
+}
+
+func Test_PoolSetupRetry(t *testing.T) {
+	setupErr := errors.New("setup error")
+	setups := int32(0)
+
+	pool, err := NewPool(PoolOptions{
+		Size:    1,
+		MaxUses: 1,
+		Setup: func(e *Engine) (*Context, error) {
+			if atomic.AddInt32(&setups, 1) > 1 {
+				return nil, setupErr
+			}
+			return e.NewContext(nil), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	pe, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every waiting Acquire retries the failing setup in turn
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := pool.Acquire(context.Background())
+			errs <- err
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	pool.Release(pe)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if err != setupErr {
+				t.Fatal("setup error not returned:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Acquire not woken after a failed retry")
+		}
+	}
+}
+
+func Test_PoolSetupPanic(t *testing.T) {
+	setups := int32(0)
+
+	pool, err := NewPool(PoolOptions{
+		Size:    1,
+		MaxUses: 1,
+		Setup: func(e *Engine) (*Context, error) {
+			if atomic.AddInt32(&setups, 1) > 1 {
+				panic("setup panic")
+			}
+			return e.NewContext(nil), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	pe, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the replacement panics on its own goroutine
+	pool.Release(pe)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := pool.Acquire(ctx); err == nil || err.Error() != "v8: pool setup panicked: setup panic" {
+		t.Fatal("setup panic not returned:", err)
+	}
+
+	if stats := pool.Stats(); stats.SetupErrors != 2 {
+		t.Fatal("setup panics not counted:", stats.SetupErrors)
+	}
+}
+
+func Test_ContextPool(t *testing.T) {
+	poolEngine := NewEngine()
+	defer poolEngine.Dispose()
+
+	bootstrap := []*Script{
+		poolEngine.Compile([]byte("var lib = {add: function(a, b) { return a + b; }};"), nil, nil),
+		poolEngine.Compile([]byte("var answer = lib.add(40, 2);"), nil, nil),
+	}
+
+	if _, err := poolEngine.NewContextPool(nil, []*Script{
+		poolEngine.Compile([]byte("throw new Error('bootstrap')"), nil, nil),
+	}); err == nil {
+		t.Fatal("bootstrap error not returned")
+	}
+
+	pool, err := poolEngine.NewContextPool(nil, bootstrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	for i := 0; i < 5; i++ {
+		c, err := pool.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Scope(func(cs ContextScope) {
+			if cs.Eval("answer").ToInteger() != 42 {
+				t.Fatal("bootstrap not run")
+			}
+			if cs.Eval("typeof leaked").ToString() != "undefined" || cs.Eval("lib.add(1, 1)").ToInteger() != 2 {
+				t.Fatal("globals leaked between borrowers")
+			}
+			cs.Eval("var leaked = 1; lib.add = function() { return 0; };")
+
+			func() {
+				defer func() {
+					if r := recover(); r != "v8: context returned to the pool inside its scope" {
+						t.Fatal("context returned while in use:", r)
+					}
+				}()
+				pool.Put(c)
+			}()
+		})
+
+		pool.Put(c)
+
+		func() {
+			defer func() {
+				if r := recover(); r != "v8: context is disposed" {
+					t.Fatal("context usable after Put:", r)
+				}
+			}()
+			c.Scope(func(cs ContextScope) {
+				t.Fatal("scope of a returned context entered")
+			})
+		}()
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "v8: context was not borrowed from this pool" {
+				t.Fatal("foreign context accepted:", r)
+			}
+		}()
+		pool.Put(poolEngine.NewContext(nil))
+	}()
+}
+
+func Test_RunIn(t *testing.T) {
+	script := engine.CompileUnbound([]byte("typeof marker"), nil, nil)
+	throwing := engine.CompileUnbound([]byte("throw new Error('run in')"), nil, nil)
+
+	engine.NewContext(nil).Scope(func(outer ContextScope) {
+		outer.Eval("var marker = 1")
+
+		engine.NewContext(nil).Scope(func(inner ContextScope) {
+			if script.Run().ToString() != "undefined" {
+				t.Fatal("Run not in the entered context")
+			}
+
+			if script.RunIn(outer).ToString() != "number" {
+				t.Fatal("RunIn not in the given context")
+			}
+
+			if script.RunIn(inner).ToString() != "undefined" {
+				t.Fatal("RunIn not in the given context")
+			}
+
+			if _, err := throwing.RunInE(outer); err == nil || !strings.Contains(err.Error(), "run in") {
+				t.Fatal("exception not returned:", err)
+			}
+
+			// callbacks get the context the script runs in
+			var called *Context
+			callback := engine.NewFunctionTemplate(func(info FunctionCallbackInfo) {
+				called = info.CurrentScope().context
+			}, nil).NewFunction()
+			outer.Global().SetProperty("callback", callback, PA_None)
+
+			engine.CompileUnbound([]byte("callback()"), nil, nil).RunIn(outer)
+			if called != outer.context {
+				t.Fatal("callback not called in the RunIn context")
 			}
 		})
-		if exception != "" {
-			t.Fatalf("exception found:%s", exception)
-		}
 	})
-}
-
-func Test_MessageListener(t *testing.T) {
-	engine.NewContext(nil).Scope(func(cs ContextScope) {
-		cs.AddMessageListener(true, func(message string, data interface{}) {
-			println("golang", message)
-		}, nil)
-		script := engine.Compile([]byte(`var test[ = ;`), nil, nil)
-		if script != nil {
-			script.Run()
-		}
 
-		SetCaptureStackTraceForUncaughtExceptions(true, 1)
-		cs.AddMessageListener(false, func(message string, data interface{}) {
-			println("golang2", message)
-		}, nil)
-		script = engine.Compile([]byte(`var test] = ;`), nil, nil)
-		if script != nil {
-			script.Run()
-		}
+	otherEngine := NewEngine()
+	defer otherEngine.Dispose()
 
-		cs.AddMessageListener(true, nil, nil)
-		exception := cs.TryCatch(true, func() {
-			script = engine.Compile([]byte(`var test[] = ;`), nil, nil)
-			if script != nil {
-				script.Run()
+	otherEngine.NewContext(nil).Scope(func(cs ContextScope) {
+		defer func() {
+			if r := recover(); r != "v8: context scope belongs to another engine" {
+				t.Fatal("script run in another engine:", r)
 			}
-		})
-		if exception != "" {
-			println("exception:", exception)
-		}
+		}()
+		script.RunIn(cs)
 	})
 }
 
-func Test_HelloWorld(t *testing.T) {
+func Test_NewDate(t *testing.T) {
 	engine.NewContext(nil).Scope(func(cs ContextScope) {
-		if cs.Eval("'Hello ' + 'World!'").ToString() != "Hello World!" {
-			t.Fatal("result not match")
+		for _, value := range []time.Time{
+			{},
+			time.Date(1969, 12, 31, 23, 59, 59, 999000000, time.UTC),
+			time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC),
+		} {
+			date := cs.NewDate(value)
+			if !date.IsDate() || date.ToNumber() != float64(value.UnixMilli()) {
+				t.Fatal("date not match:", value, date.ToNumber())
+			}
 		}
 	})
-
-	runtime.GC()
 }
 
-func Test_TryCatch(t *testing.T) {
+func Test_ObjectTemplateDisposed(t *testing.T) {
 	engine.NewContext(nil).Scope(func(cs ContextScope) {
-		cs.TryCatch(true, func() {
-			engine.Compile([]byte("a[=1"), nil, nil)
-		})
+		template := engine.NewObjectTemplate()
+		template.Dispose()
 
-		if cs.TryCatch(true, func() {
-			cs.ThrowException("this is error")
-		}) != "this is error" {
-			t.Fatal("error message not match")
+		setters := map[string]func(){
+			"SetProperty": func() {
+				template.SetProperty("a", cs.NewInteger(1), PA_None)
+			},
+			"SetInternalFieldCount": func() {
+				template.SetInternalFieldCount(1)
+			},
+			"SetAccessor": func() {
+				template.SetAccessor("a", func(string, AccessorCallbackInfo) {}, nil, nil, PA_None)
+			},
+			"SetNamedPropertyHandler": func() {
+				template.SetNamedPropertyHandler(func(string, PropertyCallbackInfo) {}, nil, nil, nil, nil, nil)
+			},
+			"SetIndexedPropertyHandler": func() {
+				template.SetIndexedPropertyHandler(func(uint32, PropertyCallbackInfo) {}, nil, nil, nil, nil, nil)
+			},
+			"WrapObject": func() {
+				template.WrapObject(cs.NewObject())
+			},
 		}
-	})
 
-	runtime.GC()
+		for name, setter := range setters {
+			func() {
+				defer func() {
+					if r := recover(); r != "v8: object template is disposed" {
+						t.Fatal(name, "usable after Dispose:", r)
+					}
+				}()
+				setter()
+			}()
+		}
+	})
 }
 
 func Test_PreCompile(t *testing.T) {
@@ -758,14 +2429,16 @@ func Test_ObjectConstructor(t *testing.T) {
 		func(name string, info PropertyCallbackInfo) {
 			//t.Logf("get %s", name)
 			get_called = get_called || name == "abc"
-			data := info.This().ToObject().GetInternalField(0).(*MyClass)
+			field, _ := info.This().ToObject().GetInternalField(0)
+			data := field.(*MyClass)
 			cs := info.CurrentScope()
 			info.ReturnValue().Set(cs.NewString(data.name))
 		},
 		func(name string, value *Value, info PropertyCallbackInfo) {
 			//t.Logf("set %s", name)
 			set_called = set_called || name == "abc"
-			data := info.This().ToObject().GetInternalField(0).(*MyClass)
+			field, _ := info.This().ToObject().GetInternalField(0)
+			data := field.(*MyClass)
 			data.name = value.ToString()
 			info.ReturnValue().Set(value)
 		},
@@ -803,8 +2476,8 @@ func Test_ObjectConstructor(t *testing.T) {
 		`).ToObject()
 
 		object.GetPropertyAttributes("abc")
-		data := object.GetInternalField(0).(*MyClass)
-		if data.name != "1" {
+		value, _ := object.GetInternalField(0)
+		if value.(*MyClass).name != "1" {
 			t.Fatal("InternalField failed")
 		}
 
@@ -983,6 +2656,274 @@ func Test_JSON(t *testing.T) {
 	runtime.GC()
 }
 
+func Test_NewValue(t *testing.T) {
+	type Server struct {
+		Host     string `js:"host"`
+		Port     int    `js:"port"`
+		Disabled bool   `js:"disabled,omitempty"`
+		secret   string
+	}
+
+	type Config struct {
+		Name    string
+		Servers []Server         `js:"servers"`
+		Tags    map[string]int   `js:"tags"`
+		Raw     []byte           `js:"raw"`
+		Extra   *Server          `js:"extra"`
+		Ignored string           `js:"-"`
+		Created time.Time        `js:"created"`
+		Any     []interface{}    `js:"any"`
+		Nested  map[string][]int `js:"nested"`
+	}
+
+	config := Config{
+		Name:    "test",
+		Servers: []Server{{"a", 80, false, "x"}, {"b", 8080, true, "y"}},
+		Tags:    map[string]int{"x": 1, "y": 2},
+		Raw:     []byte("raw"),
+		Ignored: "ignored",
+		Created: time.Unix(1386633600, 0),
+		Any:     []interface{}{1, "two", 3.5, true, nil},
+		Nested:  map[string][]int{"a": {1, 2}},
+	}
+
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		value, err := cs.NewValue(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(ToJSON(value.ToObject().GetProperty("servers"))) != `[{"host":"a","port":80},{"host":"b","port":8080,"disabled":true}]` {
+			t.Fatal(`servers not match:`, string(ToJSON(value.ToObject().GetProperty("servers"))))
+		}
+
+		cs.Global().SetProperty("config", value, PA_None)
+
+		checks := []string{
+			`config.Name === "test"`,
+			`config.tags.x === 1 && config.tags.y === 2`,
+			`config.raw === "raw"`,
+			`config.extra === null`,
+			`!("Ignored" in config) && !("secret" in config.servers[0])`,
+			`config.created instanceof Date && config.created.getTime() === 1386633600000`,
+			`config.any[0] === 1 && config.any[1] === "two" && config.any[2] === 3.5 && config.any[3] === true && config.any[4] === null`,
+			`config.nested.a.length === 2 && config.nested.a[1] === 2`,
+		}
+
+		for _, check := range checks {
+			if !cs.Eval(check).IsTrue() {
+				t.Fatal(check)
+			}
+		}
+
+		object := cs.NewObject()
+		if value, err := cs.NewValue(object); err != nil || value != object {
+			t.Fatal(`NewValue(*Value) not passed through`)
+		}
+
+		if _, err := cs.NewValue(make(chan int)); err == nil {
+			t.Fatal(`NewValue(chan) should fail`)
+		}
+
+		if _, err := cs.NewValue(map[int]string{1: "a"}); err == nil {
+			t.Fatal(`NewValue(map[int]string) should fail`)
+		}
+
+		type Node struct {
+			Next *Node
+		}
+		node := &Node{}
+		node.Next = &Node{node}
+		if _, err := cs.NewValue(node); err == nil || err.Error() != "v8: cyclic value of type *v8.Node" {
+			t.Fatal(`pointer cycle not detected:`, err)
+		}
+
+		cyclicMap := map[string]interface{}{}
+		cyclicMap["self"] = cyclicMap
+		if _, err := cs.NewValue(cyclicMap); err == nil {
+			t.Fatal(`map cycle not detected`)
+		}
+
+		cyclicSlice := []interface{}{nil}
+		cyclicSlice[0] = cyclicSlice
+		if _, err := cs.NewValue(cyclicSlice); err == nil {
+			t.Fatal(`slice cycle not detected`)
+		}
+
+		// shared values that don't contain themselves are fine
+		shared := &Server{Host: "shared"}
+		if _, err := cs.NewValue([]*Server{shared, shared}); err != nil {
+			t.Fatal(err)
+		}
+
+		type Embedded struct {
+			*Server
+			Name string
+		}
+		value, err = cs.NewValue(Embedded{&Server{Host: "a", Port: 80}, "x"})
+		if err != nil || string(ToJSON(value)) != `{"host":"a","port":80,"Name":"x"}` {
+			t.Fatal(`embedded pointer not promoted:`, string(ToJSON(value)), err)
+		}
+		value, err = cs.NewValue(Embedded{nil, "x"})
+		if err != nil || string(ToJSON(value)) != `{"Name":"x"}` {
+			t.Fatal(`nil embedded pointer not skipped:`, string(ToJSON(value)), err)
+		}
+
+		var embedded Embedded
+		if err := cs.Eval(`({host: "b", Name: "y"})`).Unmarshal(&embedded); err != nil {
+			t.Fatal(err)
+		}
+		if embedded.Server == nil || embedded.Host != "b" || embedded.Name != "y" {
+			t.Fatal(`embedded pointer not allocated:`, embedded)
+		}
+	})
+
+	runtime.GC()
+}
+
+func Test_Unmarshal(t *testing.T) {
+	type Server struct {
+		Host string `js:"host"`
+		Port uint16 `js:"port"`
+	}
+
+	type Config struct {
+		Name    string                 `js:"name"`
+		Servers []Server               `js:"servers"`
+		Tags    map[string]int         `js:"tags"`
+		Backup  *Server                `js:"backup"`
+		Created time.Time              `js:"created"`
+		Extra   map[string]interface{} `js:"extra"`
+		Raw     *Value                 `js:"raw"`
+	}
+
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		var result struct {
+			Config Config `js:"config"`
+		}
+
+		value := cs.Eval(`({config: {
+			name: "test",
+			servers: [{host: "a", port: 80}, {host: "b", port: 8080}],
+			tags: {x: 1, y: 2},
+			backup: {host: "c", port: 443},
+			created: new Date(1386633600000),
+			extra: {list: [1, "two", null], flag: true},
+			raw: [1, 2, 3]
+		}})`)
+
+		if err := value.Unmarshal(&result); err != nil {
+			t.Fatal(err)
+		}
+
+		config := result.Config
+
+		if config.Name != "test" || len(config.Servers) != 2 || config.Servers[1].Host != "b" || config.Servers[1].Port != 8080 {
+			t.Fatal(`servers not match`)
+		}
+
+		if config.Tags["x"] != 1 || config.Tags["y"] != 2 {
+			t.Fatal(`tags not match`)
+		}
+
+		if config.Backup == nil || config.Backup.Port != 443 {
+			t.Fatal(`backup not match`)
+		}
+
+		if !config.Created.Equal(time.Unix(1386633600, 0)) {
+			t.Fatal(`created not match`)
+		}
+
+		if list, ok := config.Extra["list"].([]interface{}); !ok || len(list) != 3 || list[0] != 1.0 || list[1] != "two" || list[2] != nil {
+			t.Fatal(`extra.list not match`)
+		}
+
+		if config.Extra["flag"] != true {
+			t.Fatal(`extra.flag not match`)
+		}
+
+		if config.Raw == nil || !config.Raw.IsArray() {
+			t.Fatal(`raw not match`)
+		}
+
+		err := cs.Eval(`({config: {servers: [{port: 1}, {port: 2}, {port: "x"}]}})`).Unmarshal(&result)
+		if err == nil || err.Error() != "config.servers[2].port: expected number, got string" {
+			t.Fatal(`type mismatch error not match:`, err)
+		}
+
+		err = cs.Eval(`({config: {servers: [{port: 70000}]}})`).Unmarshal(&result)
+		if err == nil || err.Error() != "config.servers[0].port: expected uint16, got number 70000" {
+			t.Fatal(`range error not match:`, err)
+		}
+
+		if err := value.Unmarshal(result); err == nil {
+			t.Fatal(`Unmarshal(non-pointer) should fail`)
+		}
+
+		var dates struct {
+			Old time.Time   `js:"old"`
+			New time.Time   `js:"new"`
+			Any interface{} `js:"any"`
+		}
+		if err := cs.Eval(`({old: new Date(-62135596800000), new: new Date(32503680000000)})`).Unmarshal(&dates); err != nil {
+			t.Fatal(err)
+		}
+		if !dates.Old.Equal(time.Time{}) || dates.New.Year() != 3000 {
+			t.Fatal(`dates outside the int64 nanosecond range not match:`, dates.Old, dates.New)
+		}
+
+		if err := cs.Eval(`({old: null, new: undefined})`).Unmarshal(&dates); err != nil || dates.New.Year() != 3000 {
+			t.Fatal(`null date not ignored:`, err)
+		}
+
+		err = cs.Eval(`({old: new Date(NaN)})`).Unmarshal(&dates)
+		if err == nil || err.Error() != "old: expected date, got invalid date" {
+			t.Fatal(`invalid date error not match:`, err)
+		}
+
+		err = cs.Eval(`({any: [new Date(NaN)]})`).Unmarshal(&dates)
+		if err == nil || err.Error() != "any[0]: expected date, got invalid date" {
+			t.Fatal(`invalid date error not match:`, err)
+		}
+
+		type Node struct {
+			Next *Node `js:"next"`
+		}
+		var node Node
+		err = cs.Eval(`var node = {}; node.next = {next: node}; node`).Unmarshal(&node)
+		if err == nil || err.Error() != "v8: cyclic value at next.next" {
+			t.Fatal(`cycle not detected:`, err)
+		}
+
+		var any interface{}
+		err = cs.Eval(`var list = [1]; list.push({list: list}); list`).Unmarshal(&any)
+		if err == nil || err.Error() != "v8: cyclic value at [1].list" {
+			t.Fatal(`cycle not detected:`, err)
+		}
+
+		// shared objects that don't contain themselves are fine
+		err = cs.Eval(`var shared = {}; ({a: shared, b: [shared, shared]})`).Unmarshal(&any)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var untagged struct {
+			Name    string
+			MaxSize int
+			Port    int
+		}
+		err = cs.Eval(`({name: "lower", maxsize: 10, port: 1, Port: 2})`).Unmarshal(&untagged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if untagged.Name != "lower" || untagged.MaxSize != 10 || untagged.Port != 2 {
+			t.Fatal(`case-insensitive field names not match:`, untagged)
+		}
+	})
+
+	runtime.GC()
+}
+
 func rand_sched(max int) {
 	for j := rand.Intn(max); j > 0; j-- {
 		runtime.Gosched()
@@ -1246,6 +3187,22 @@ func Benchmark_NewArray100(b *testing.B) {
 	b.StartTimer()
 }
 
+func Benchmark_NewArray100HandleScope(b *testing.B) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		for i := 0; i < b.N; i += 1000 {
+			cs.HandleScope(func(hs HandleScope) {
+				for j := i; j < i+1000 && j < b.N; j++ {
+					hs.NewArray(100)
+				}
+			})
+		}
+	})
+
+	b.StopTimer()
+	runtime.GC()
+	b.StartTimer()
+}
+
 func Benchmark_Compile(b *testing.B) {
 	b.StopTimer()
 	code, err := ioutil.ReadFile("labs/underscore.js")
@@ -1298,6 +3255,32 @@ func Benchmark_RunScript(b *testing.B) {
 	b.StartTimer()
 }
 
+func Benchmark_RunScriptIn(b *testing.B) {
+	b.StopTimer()
+	contexts := []*Context{engine.NewContext(nil), engine.NewContext(nil), engine.NewContext(nil)}
+	script := engine.CompileUnbound([]byte("1+1"), nil, nil)
+	b.StartTimer()
+
+	contexts[0].Scope(func(cs ContextScope) {
+		scopes := make([]ContextScope, len(contexts))
+		for i, c := range contexts {
+			scopes[i], _ = c.Enter()
+		}
+
+		for i := 0; i < b.N; i++ {
+			script.RunIn(scopes[i%len(scopes)])
+		}
+
+		for i := len(scopes) - 1; i >= 0; i-- {
+			scopes[i].Exit()
+		}
+	})
+
+	b.StopTimer()
+	runtime.GC()
+	b.StartTimer()
+}
+
 func Benchmark_JsFunction(b *testing.B) {
 	b.StopTimer()
 
@@ -1375,6 +3358,42 @@ func Benchmark_Getter(b *testing.B) {
 	b.StartTimer()
 }
 
+func Benchmark_GetterHandleScope(b *testing.B) {
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		b.StopTimer()
+		var propertyValue int32 = 1234
+
+		template := engine.NewObjectTemplate()
+
+		template.SetAccessor(
+			"abc",
+			func(name string, info AccessorCallbackInfo) {
+				data := info.Data().(*int32)
+				info.ReturnValue().SetInt32(*data)
+			},
+			nil,
+			&propertyValue,
+			PA_None,
+		)
+
+		object := template.NewObject().ToObject()
+
+		b.StartTimer()
+
+		for i := 0; i < b.N; i += 1000 {
+			cs.HandleScope(func(hs HandleScope) {
+				for j := i; j < i+1000 && j < b.N; j++ {
+					object.GetProperty("abc")
+				}
+			})
+		}
+	})
+
+	b.StopTimer()
+	runtime.GC()
+	b.StartTimer()
+}
+
 func Benchmark_Setter(b *testing.B) {
 	engine.NewContext(nil).Scope(func(cs ContextScope) {
 		b.StopTimer()
@@ -1420,3 +3439,67 @@ func Benchmark_TryCatch(b *testing.B) {
 		}
 	})
 }
+
+func Benchmark_ScopeParallel(b *testing.B) {
+	context := engine.NewContext(nil)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			context.Scope(func(cs ContextScope) {
+				cs.NewInteger(1)
+			})
+		}
+	})
+}
+
+// The workload of Test_ThreadSafe1, many goroutines competing for the
+// isolate lock against the same work queued on the executor.
+//
+func Benchmark_ThreadSafeContention(b *testing.B) {
+	contentionEngine := NewEngine()
+	defer contentionEngine.Dispose()
+
+	work := func(cs ContextScope) {
+		script := contentionEngine.Compile([]byte("'Hello ' + 'World!'"), nil, nil)
+		if script.Run().ToString() != "Hello World!" {
+			b.Error("result not match")
+		}
+	}
+
+	b.Run("Scope", func(b *testing.B) {
+		context := contentionEngine.NewContext(nil)
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				context.Scope(work)
+			}
+		})
+	})
+
+	b.Run("Executor", func(b *testing.B) {
+		executor := contentionEngine.Executor()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				executor.Do(work)
+			}
+		})
+	})
+}
+
+func Benchmark_ExecutorParallel(b *testing.B) {
+	executorEngine := NewEngine()
+	defer executorEngine.Dispose()
+
+	executor := executorEngine.Executor()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			executor.Do(func(cs ContextScope) {
+				cs.NewInteger(1)
+			})
+		}
+	})
+}
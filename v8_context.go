@@ -6,20 +6,43 @@ package v8
 */
 import "C"
 import "unsafe"
+import "fmt"
 import "runtime"
-
-//import "reflect"
+import "runtime/debug"
+import "reflect"
+import "sync"
+import "sync/atomic"
 
 // A sandboxed execution context with its own set of built-in objects
 // and functions.
 type Context struct {
 	embedable
-	self   unsafe.Pointer
-	engine *Engine
+	self     unsafe.Pointer
+	engine   *Engine
+	entered  int32
+	disposed int32
 }
 
 type ContextScope struct {
 	context *Context
+	entered *enteredScope
+
+	// the outermost scope of the engine this scope belongs to, it is
+	// only valid while that one lasts
+	epoch int64
+}
+
+func newContextScope(c *Context, entered *enteredScope) ContextScope {
+	return ContextScope{c, entered, atomic.LoadInt64(&c.engine.scopeEpoch)}
+}
+
+// A context scope opened by Enter, the scopes of an engine are exited
+// in reverse order.
+type enteredScope struct {
+	self    unsafe.Pointer
+	handle  goHandle
+	context *Context
+	prev    *enteredScope
 }
 
 func (cs ContextScope) GetEngine() *Engine {
@@ -37,9 +60,10 @@ func (cs ContextScope) SetPrivateData(data interface{}) {
 func (e *Engine) NewContext(globalTemplate *ObjectTemplate) *Context {
 	var globalTemplatePtr unsafe.Pointer
 	if globalTemplate != nil {
+		e.checkOwner(globalTemplate.engine, "object template")
 		globalTemplatePtr = globalTemplate.self
 	}
-	self := C.V8_NewContext(e.self, globalTemplatePtr)
+	self := C.V8_NewContext(e.ptr(), globalTemplatePtr)
 
 	if self == nil {
 		return nil
@@ -50,37 +74,290 @@ func (e *Engine) NewContext(globalTemplate *ObjectTemplate) *Context {
 		engine: e,
 	}
 
+	e.track(&e.contexts, self)
+
 	runtime.SetFinalizer(result, func(c *Context) {
-		if traceDispose {
-			println("v8.Context.Dispose()", c.self)
-		}
-		C.V8_DisposeContext(c.self)
+		c.engine.untrack(&c.engine.contexts, &c.engine.queuedContexts, c.self)
 	})
 
 	return result
 }
 
+func (c *Context) ptr() unsafe.Pointer {
+	c.engine.ptr()
+	if atomic.LoadInt32(&c.disposed) != 0 {
+		panic("v8: context is disposed")
+	}
+	return c.self
+}
+
+func (cs ContextScope) ptr() unsafe.Pointer {
+	e := cs.context.engine
+	if atomic.LoadInt32(&e.scopeDepth) == 0 || atomic.LoadInt64(&e.scopeEpoch) != cs.epoch {
+		if e.isSuspended(cs.epoch) {
+			panic("v8: context scope used inside Unlocked")
+		}
+		panic("v8: context scope used outside of its scope")
+	}
+	if debugScopes {
+		if atomic.LoadInt32(&cs.context.entered) == 0 {
+			panic("v8: context scope used after it ended")
+		}
+		// the scope is open, but maybe on another goroutine
+		if C.V8_IsLockedByThread(e.ptr()) == 0 {
+			panic("v8: context scope used by a goroutine outside of it")
+		}
+	}
+	return cs.context.ptr()
+}
+
 //export context_scope_callback
-func context_scope_callback(c unsafe.Pointer, callback unsafe.Pointer) {
-	(*(*func(ContextScope))(callback))(ContextScope{(*Context)(c)})
+func context_scope_callback(context, callback C.V8_GoHandle) {
+	f := goHandle(callback).value().(func(ContextScope))
+	f(ContextScope{context: goHandle(context).value().(*Context)})
+}
+
+// A panic recovered inside a C call, re-panicked once the C frames
+// have returned and released the isolate.
+type goPanic struct {
+	value interface{}
+}
+
+func (p *goPanic) recover() {
+	if r := recover(); r != nil {
+		p.value = r
+	}
+}
+
+func (p *goPanic) repanic() {
+	if p.value != nil {
+		panic(p.value)
+	}
 }
 
 func (c *Context) Scope(callback func(ContextScope)) {
-	C.V8_Context_Scope(c.self, unsafe.Pointer(c), unsafe.Pointer(&callback))
+	var p goPanic
+	wrapped := func(cs ContextScope) {
+		defer p.recover()
+
+		e := cs.context.engine
+		e.enterScope(cs.context)
+		defer e.leaveScope(cs.context, e.entered)
+		cs = newContextScope(cs.context, nil)
+
+		e.disposeQueued()
+		callback(cs)
+	}
+	self := c.ptr()
+	contextHandle := newGoHandle(c)
+	callbackHandle := newGoHandle(wrapped)
+	C.V8_Context_Scope(self, contextHandle.c(), callbackHandle.c())
+	contextHandle.delete()
+	callbackHandle.delete()
+	p.repanic()
+}
+
+// Like Scope, but returns the error of the callback. The engine state
+// errors ErrEngineDisposed and ErrEngineDead are returned instead of
+// a panic.
+//
+func (c *Context) ScopeE(callback func(ContextScope) error) (err error) {
+	if err := c.engine.checkUsable(); err != nil {
+		return err
+	}
+
+	c.Scope(func(cs ContextScope) {
+		err = callback(cs)
+	})
+
+	return err
+}
+
+// Opens a context scope that stays open until Exit, e.g. across the
+// Go calls of a request handler. The engine is locked by the calling
+// goroutine, which is pinned to its thread until Exit, other
+// goroutines using the engine block meanwhile. Scopes can be nested
+// and must be exited in reverse order, scopes left open by a Scope
+// callback are exited when it returns.
+//
+func (c *Context) Enter() (ContextScope, error) {
+	e := c.engine
+	if err := e.checkUsable(); err != nil {
+		return ContextScope{}, err
+	}
+
+	self := c.ptr()
+	runtime.LockOSThread()
+
+	handle := newGoHandle(c)
+
+	// e.entered belongs to the goroutine holding the isolate, it must
+	// only be read once V8_Context_Enter locked it
+	entered := C.V8_Context_Enter(self, handle.c())
+	scope := &enteredScope{
+		self:    entered,
+		handle:  handle,
+		context: c,
+		prev:    e.entered,
+	}
+
+	e.entered = scope
+	e.enterScope(c)
+	e.disposeQueued()
+
+	return newContextScope(c, scope), nil
+}
+
+// Exits a context scope opened by Enter. The values created in it
+// can't be used afterwards unless another scope of the engine is
+// still open. Only the goroutine that called Enter can exit it.
+//
+func (cs ContextScope) Exit() {
+	scope := cs.entered
+	if scope == nil {
+		panic("v8: context scope was not opened by Enter")
+	}
+
+	if scope.self == nil {
+		panic("v8: context scope already exited")
+	}
+
+	// Enter locked the goroutine to the thread holding the isolate
+	if C.V8_Context_EnteredByThread(scope.self) == 0 {
+		panic("v8: context scope exited by another goroutine")
+	}
+
+	e := cs.context.engine
+	if e.entered != scope {
+		panic("v8: context scopes must be exited in reverse order")
+	}
+
+	e.exitEntered()
+}
+
+func (e *Engine) exitEntered() {
+	scope := e.entered
+	e.entered = scope.prev
+
+	C.V8_Context_Exit(scope.self)
+	scope.self = nil
+	scope.handle.delete()
+	e.exitScope(scope.context)
+
+	runtime.UnlockOSThread()
+}
+
+// Values remember the outermost scope they were created in, they are
+// only valid while it is open.
+//
+func (e *Engine) enterScope(c *Context) {
+	atomic.AddInt32(&c.entered, 1)
+	if atomic.AddInt32(&e.scopeDepth, 1) == 1 {
+		atomic.StoreInt64(&e.scopeEpoch, atomic.AddInt64(&e.lastEpoch, 1))
+	}
+}
+
+func (e *Engine) exitScope(c *Context) {
+	atomic.AddInt32(&c.entered, -1)
+	atomic.AddInt32(&e.scopeDepth, -1)
+}
+
+func (e *Engine) leaveScope(c *Context, entered *enteredScope) {
+	leftOpen := e.entered != entered
+	for e.entered != entered {
+		e.exitEntered()
+	}
+
+	e.exitScope(c)
+
+	if leftOpen {
+		panic("v8: context scope opened by Enter was not exited")
+	}
 }
 
 //export try_catch_callback
-func try_catch_callback(callback unsafe.Pointer) {
-	(*(*func())(callback))()
+func try_catch_callback(callback C.V8_GoHandle) {
+	goHandle(callback).value().(func())()
+}
+
+// The Go context of the scope a callback runs in.
+//
+func callbackContext(context C.V8_GoHandle) *Context {
+	return goHandle(context).value().(*Context)
+}
+
+// Unwinding a panic through the V8 frames of a callback would leave
+// the isolate locked and corrupted, so the trampolines recover it and
+// throw it to the calling script as an Error instead.
+//
+func (c *Context) recoverCallbackPanic() {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	stack := debug.Stack()
+
+	c.engine.hooks.report(value, stack)
+
+	cs := newContextScope(c, nil)
+	err := cs.newError(C.ET_Error, fmt.Sprintf("Go panic: %v", value))
+	errObject := err.ToObject()
+	errObject.SetProperty("goPanic", cs.NewString(fmt.Sprint(value)), PA_None)
+	errObject.SetProperty("goStack", cs.NewString(string(stack)), PA_None)
+	cs.Throw(err)
 }
 
+// Throws a string as JavaScript exception.
+//
 func (cs ContextScope) ThrowException(err string) {
-	cs.context.engine.Compile([]byte(`throw "`+err+`"`), nil, nil).Run()
-	//
-	// TODO: use Isolate::ThrowException() will make FunctionTemplate::GetFunction() returns NULL, why?
-	//
-	//errPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&err)).Data)
-	//C.V8_Context_ThrowException(c.self, (*C.char)(errPtr), C.int(len(err)))
+	cs.Throw(cs.NewString(err))
+}
+
+// Throws any value as JavaScript exception. Inside a FunctionTemplate
+// callback, accessor or interceptor the exception is delivered to the
+// calling script when the callback returns, so the callback should
+// return right after throwing.
+//
+func (cs ContextScope) Throw(value *Value) {
+	C.V8_Context_ThrowException(cs.ptr(), value.ptrFor(cs.context.engine))
+}
+
+// Throws a new Error with the given message.
+//
+func (cs ContextScope) ThrowError(message string) {
+	cs.Throw(cs.newError(C.ET_Error, message))
+}
+
+// Throws a new TypeError with the given message.
+//
+func (cs ContextScope) ThrowTypeError(message string) {
+	cs.Throw(cs.newError(C.ET_TypeError, message))
+}
+
+// Throws a new RangeError with the given message.
+//
+func (cs ContextScope) ThrowRangeError(message string) {
+	cs.Throw(cs.newError(C.ET_RangeError, message))
+}
+
+// Throws a new SyntaxError with the given message.
+//
+func (cs ContextScope) ThrowSyntaxError(message string) {
+	cs.Throw(cs.newError(C.ET_SyntaxError, message))
+}
+
+// Throws a new ReferenceError with the given message.
+//
+func (cs ContextScope) ThrowReferenceError(message string) {
+	cs.Throw(cs.newError(C.ET_ReferenceError, message))
+}
+
+func (cs ContextScope) newError(typ C.ErrorTypeEnum, message string) *Value {
+	messagePtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&message)).Data)
+	return newValue(cs.context.engine, C.V8_Context_NewError(
+		cs.ptr(), (*C.char)(messagePtr), C.int(len(message)), typ,
+	))
 }
 
 func (cs ContextScope) TryCatch(simple bool, callback func()) string {
@@ -88,12 +365,22 @@ func (cs ContextScope) TryCatch(simple bool, callback func()) string {
 	if simple {
 		isSimple = 1
 	}
-	creport := C.V8_Context_TryCatch(cs.context.self, unsafe.Pointer(&callback), C.int(isSimple))
+	var p goPanic
+	wrapped := func() {
+		defer p.recover()
+		callback()
+	}
+	self := cs.ptr()
+	callbackHandle := newGoHandle(wrapped)
+	creport := C.V8_Context_TryCatch(self, callbackHandle.c(), C.int(isSimple))
+	callbackHandle.delete()
 	if creport == nil {
+		p.repanic()
 		return ""
 	}
 	report := C.GoString(creport)
 	C.free(unsafe.Pointer(creport))
+	p.repanic()
 	return report
 }
 
@@ -105,23 +392,48 @@ func (cs ContextScope) AddMessageListener(simple bool, callback MessageCallback,
 		goSimple = 1
 	}
 
-	var callbackPointer unsafe.Pointer
-	if callback != nil {
-		callbackPointer = unsafe.Pointer(&callback)
+	messageListenerMutex.Lock()
+	defer messageListenerMutex.Unlock()
+
+	// a nil callback removes all listeners
+	if callback == nil {
+		for _, h := range messageListeners {
+			h.delete()
+		}
+		messageListeners = nil
+		C.V8_AddMessageListener(0, C.int(goSimple))
+		return
 	}
-	C.V8_AddMessageListener(
-		callbackPointer,
-		unsafe.Pointer(&data),
-		C.int(goSimple))
+
+	h := newGoHandle(&messageListenerInfo{callback, data})
+	messageListeners = append(messageListeners, h)
+	C.V8_AddMessageListener(h.c(), C.int(goSimple))
+}
+
+type messageListenerInfo struct {
+	callback MessageCallback
+	data     interface{}
 }
 
+var (
+	messageListenerMutex sync.Mutex
+	messageListeners     []goHandle
+)
+
+// Listeners are global, a panic is reported to the engine the message
+// came from.
+//
 //export go_message_callback
-func go_message_callback(message, callback, data unsafe.Pointer) {
+func go_message_callback(message unsafe.Pointer, callback C.V8_GoHandle, engine C.int) {
 	report := C.GoString((*C.char)(message))
 	C.free(message)
-	(*(*MessageCallback)(callback))(report, *(*interface{})(data))
+
+	defer lookupHooks(engine).recoverPanic()
+
+	info := goHandle(callback).value().(*messageListenerInfo)
+	info.callback(report, info.data)
 }
 
 func (cs ContextScope) Global() *Object {
-	return newValue(C.V8_Context_Global(cs.context.self)).ToObject()
+	return newValue(cs.context.engine, C.V8_Context_Global(cs.ptr())).ToObject()
 }
@@ -0,0 +1,171 @@
+package v8
+
+import "runtime"
+import "sync"
+import "sync/atomic"
+
+// Hands out contexts that already ran the bootstrap scripts. A context
+// is never given to a second borrower, returned ones are freed and a
+// new one is prepared in the background, so no globals leak between
+// borrowers.
+//
+type ContextPool struct {
+	engine         *Engine
+	globalTemplate *ObjectTemplate
+	bootstrap      []*Script
+
+	mutex    sync.Mutex
+	ready    []*Context
+	borrowed map[*Context]bool
+	closed   bool
+	pending  sync.WaitGroup
+}
+
+// Creates a context pool of the engine and prepares its first context.
+// The bootstrap scripts run in order in every new context, their
+// exception is returned when one throws.
+//
+func (e *Engine) NewContextPool(globalTemplate *ObjectTemplate, bootstrap []*Script) (*ContextPool, error) {
+	if globalTemplate != nil {
+		e.checkOwner(globalTemplate.engine, "object template")
+	}
+
+	for _, script := range bootstrap {
+		e.checkOwner(script.engine, "script")
+	}
+
+	cp := &ContextPool{
+		engine:         e,
+		globalTemplate: globalTemplate,
+		bootstrap:      bootstrap,
+		borrowed:       make(map[*Context]bool),
+	}
+
+	c, err := cp.newContext()
+	if err != nil {
+		return nil, err
+	}
+	cp.ready = append(cp.ready, c)
+
+	return cp, nil
+}
+
+func (cp *ContextPool) newContext() (*Context, error) {
+	c := cp.engine.NewContext(cp.globalTemplate)
+
+	err := c.ScopeE(func(cs ContextScope) error {
+		for _, script := range cp.bootstrap {
+			if _, err := script.RunE(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		c.dispose()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Borrows a bootstrapped context, preparing one when none is ready.
+//
+func (cp *ContextPool) Get() (*Context, error) {
+	cp.mutex.Lock()
+	var c *Context
+	if n := len(cp.ready); n > 0 {
+		c = cp.ready[n-1]
+		cp.ready = cp.ready[:n-1]
+	}
+	cp.mutex.Unlock()
+
+	if c == nil {
+		var err error
+		if c, err = cp.newContext(); err != nil {
+			return nil, err
+		}
+	}
+
+	cp.mutex.Lock()
+	cp.borrowed[c] = true
+	cp.mutex.Unlock()
+
+	return c, nil
+}
+
+// Gives back a borrowed context once its scopes ended. The context and
+// its values must not be used afterwards.
+//
+func (cp *ContextPool) Put(c *Context) {
+	if atomic.LoadInt32(&c.entered) != 0 {
+		panic("v8: context returned to the pool inside its scope")
+	}
+
+	cp.mutex.Lock()
+	if !cp.borrowed[c] {
+		cp.mutex.Unlock()
+		panic("v8: context was not borrowed from this pool")
+	}
+	delete(cp.borrowed, c)
+	closed := cp.closed
+	if !closed {
+		cp.pending.Add(1)
+	}
+	cp.mutex.Unlock()
+
+	c.dispose()
+
+	if !closed {
+		go cp.prepare()
+	}
+}
+
+func (cp *ContextPool) prepare() {
+	defer cp.pending.Done()
+
+	// Get prepares a context itself when this fails
+	c, err := cp.newContext()
+	if err != nil {
+		return
+	}
+
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	if cp.closed {
+		c.dispose()
+		return
+	}
+	cp.ready = append(cp.ready, c)
+}
+
+// Frees the prepared contexts, waiting for the ones being prepared.
+// Borrowed contexts can still be put back, they are freed without
+// preparing new ones. Call it before disposing the engine.
+//
+func (cp *ContextPool) Close() {
+	cp.mutex.Lock()
+	cp.closed = true
+	cp.mutex.Unlock()
+
+	cp.pending.Wait()
+
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	for _, c := range cp.ready {
+		c.dispose()
+	}
+	cp.ready = nil
+}
+
+// Queues the native context to be freed instead of waiting for the
+// finalizer, any later use of the context panics.
+//
+func (c *Context) dispose() {
+	atomic.StoreInt32(&c.disposed, 1)
+	runtime.SetFinalizer(c, nil)
+	c.engine.untrack(&c.engine.contexts, &c.engine.queuedContexts, c.self)
+}
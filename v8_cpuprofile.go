@@ -0,0 +1,191 @@
+package v8
+
+/*
+#include "v8_wrap.h"
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+import "encoding/json"
+import "io"
+import "reflect"
+import "strconv"
+import "time"
+
+// A CPU profile collected between StartCPUProfile and StopCPUProfile.
+// StartTime and EndTime are in microseconds of V8's own clock.
+//
+type CPUProfile struct {
+	Title     string
+	StartTime int64
+	EndTime   int64
+	Root      *CPUProfileNode
+
+	// The leaf node of every recorded sample in order.
+	Samples []*CPUProfileNode
+
+	nodes   []*CPUProfileNode
+	stopped time.Time
+}
+
+// A node of the top-down call tree of a CPUProfile. HitCount counts
+// the samples taken in the function itself, TotalHitCount includes
+// the samples of its callees.
+//
+type CPUProfileNode struct {
+	Id            int
+	FunctionName  string
+	ScriptName    string
+	ScriptId      int
+	LineNumber    int
+	ColumnNumber  int
+	HitCount      int
+	TotalHitCount int
+	Parent        *CPUProfileNode
+	Children      []*CPUProfileNode
+}
+
+// Starts collecting a CPU profile with the given title. Profiles with
+// different titles can be collected at the same time.
+//
+func (e *Engine) StartCPUProfile(title string) {
+	titlePtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&title)).Data)
+	C.V8_StartCpuProfiling(e.ptr(), (*C.char)(titlePtr), C.int(len(title)))
+}
+
+// Stops collecting the CPU profile with the given title and returns
+// it, or nil if no profile with that title was started.
+//
+func (e *Engine) StopCPUProfile(title string) *CPUProfile {
+	titlePtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&title)).Data)
+	profile := C.V8_StopCpuProfiling(e.ptr(), (*C.char)(titlePtr), C.int(len(title)))
+
+	if profile == nil {
+		return nil
+	}
+
+	defer C.V8_DisposeCpuProfile(profile)
+
+	result := &CPUProfile{
+		Title:     C.GoString(profile.title),
+		StartTime: int64(profile.start_time),
+		EndTime:   int64(profile.end_time),
+		stopped:   time.Now(),
+	}
+
+	count := int(profile.node_count)
+	nodes := (*[1 << 24]C.V8_CpuProfileNode)(unsafe.Pointer(profile.nodes))[:count:count]
+	byId := make(map[int]*CPUProfileNode, count)
+
+	result.nodes = make([]*CPUProfileNode, count)
+
+	for i, node := range nodes {
+		n := &CPUProfileNode{
+			Id:           int(node.id),
+			FunctionName: C.GoString(node.function_name),
+			ScriptName:   C.GoString(node.script_name),
+			ScriptId:     int(node.script_id),
+			LineNumber:   int(node.line),
+			ColumnNumber: int(node.column),
+			HitCount:     int(node.hit_count),
+		}
+
+		if parent := int(node.parent); parent >= 0 {
+			n.Parent = result.nodes[parent]
+			n.Parent.Children = append(n.Parent.Children, n)
+		}
+
+		result.nodes[i] = n
+		byId[n.Id] = n
+	}
+
+	// children always come after their parent in pre-order
+	for i := count - 1; i >= 0; i-- {
+		node := result.nodes[i]
+		node.TotalHitCount += node.HitCount
+		if node.Parent != nil {
+			node.Parent.TotalHitCount += node.TotalHitCount
+		}
+	}
+
+	if count > 0 {
+		result.Root = result.nodes[0]
+	}
+
+	if sampleCount := int(profile.sample_count); sampleCount > 0 {
+		samples := (*[1 << 24]C.uint)(unsafe.Pointer(profile.samples))[:sampleCount:sampleCount]
+		result.Samples = make([]*CPUProfileNode, sampleCount)
+		for i, id := range samples {
+			result.Samples[i] = byId[int(id)]
+		}
+	}
+
+	return result
+}
+
+type chromeCallFrame struct {
+	FunctionName string `json:"functionName"`
+	ScriptId     string `json:"scriptId"`
+	URL          string `json:"url"`
+	LineNumber   int    `json:"lineNumber"`
+	ColumnNumber int    `json:"columnNumber"`
+}
+
+type chromeProfileNode struct {
+	Id        int             `json:"id"`
+	CallFrame chromeCallFrame `json:"callFrame"`
+	HitCount  int             `json:"hitCount"`
+	Children  []int           `json:"children,omitempty"`
+}
+
+type chromeProfile struct {
+	Nodes      []chromeProfileNode `json:"nodes"`
+	StartTime  int64               `json:"startTime"`
+	EndTime    int64               `json:"endTime"`
+	Samples    []int               `json:"samples"`
+	TimeDeltas []int64             `json:"timeDeltas"`
+}
+
+// Writes the profile in the Chrome DevTools .cpuprofile JSON format.
+// This V8 version doesn't record sample timestamps, so the samples
+// are spread evenly between StartTime and EndTime.
+//
+func (p *CPUProfile) WriteJSON(w io.Writer) error {
+	profile := chromeProfile{
+		Nodes:      make([]chromeProfileNode, len(p.nodes)),
+		StartTime:  p.StartTime,
+		EndTime:    p.EndTime,
+		Samples:    make([]int, len(p.Samples)),
+		TimeDeltas: make([]int64, len(p.Samples)),
+	}
+
+	for i, node := range p.nodes {
+		// DevTools line and column numbers are zero based
+		profile.Nodes[i] = chromeProfileNode{
+			Id: node.Id,
+			CallFrame: chromeCallFrame{
+				FunctionName: node.FunctionName,
+				ScriptId:     strconv.Itoa(node.ScriptId),
+				URL:          node.ScriptName,
+				LineNumber:   node.LineNumber - 1,
+				ColumnNumber: node.ColumnNumber - 1,
+			},
+			HitCount: node.HitCount,
+		}
+		for _, child := range node.Children {
+			profile.Nodes[i].Children = append(profile.Nodes[i].Children, child.Id)
+		}
+	}
+
+	if len(p.Samples) > 0 {
+		interval := (p.EndTime - p.StartTime) / int64(len(p.Samples))
+		for i, node := range p.Samples {
+			if node != nil {
+				profile.Samples[i] = node.Id
+			}
+			profile.TimeDeltas[i] = interval
+		}
+	}
+
+	return json.NewEncoder(w).Encode(profile)
+}
@@ -0,0 +1,8 @@
+// +build v8debug
+
+package v8
+
+// Built with the v8debug tag, values and context scopes check that a
+// scope of their engine is open before every call into V8.
+//
+const debugScopes = true
@@ -0,0 +1,36 @@
+// +build v8debug
+
+package v8
+
+import (
+	"testing"
+)
+
+func Test_DebugValueScope(t *testing.T) {
+	var value *Value
+
+	engine.NewContext(nil).Scope(func(cs ContextScope) {
+		value = cs.NewObject()
+
+		// the scope is still open, but held by this goroutine
+		used := make(chan interface{})
+		go func() {
+			defer func() { used <- recover() }()
+			value.ToString()
+		}()
+		if r := <-used; r != "v8: value used by a goroutine outside of its context scope" {
+			t.Fatal("value usable by another goroutine:", r)
+		}
+
+		if value.ToString() != "[object Object]" {
+			t.Fatal("value not usable in its scope")
+		}
+	})
+
+	defer func() {
+		if r := recover(); r != "v8: value used outside of its context scope" {
+			t.Fatal("value usable after its scope:", r)
+		}
+	}()
+	value.ToString()
+}
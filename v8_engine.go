@@ -6,12 +6,19 @@ package v8
 */
 import "C"
 import "unsafe"
+import "errors"
+import "math"
 import "runtime"
-
-var traceDispose = false
+import "runtime/debug"
+import "sync"
+import "sync/atomic"
 
 // Represents an isolated instance of the V8 engine.
 // Objects from one engine must not be used in other engine.
+//
+// Template callbacks stay registered until their template or the
+// engine is disposed, so an engine that a callback refers to is never
+// finalized, call Dispose when it isn't needed anymore.
 type Engine struct {
 	embedable
 	self             unsafe.Pointer
@@ -23,12 +30,171 @@ type Engine struct {
 	funcTemplates    map[int]*FunctionTemplate
 	objectTemplateId int
 	objectTemplates  map[int]*ObjectTemplate
+	handleScope      *handleScope
+	entered          *enteredScope
+	scopeDepth       int32
+	scopeEpoch       int64
+	lastEpoch        int64
+	hookId           int
+	hooks            *engineHooks
+	leakReport       func(LeakReport)
+
+	// Held for reading while queued handles are freed, so Dispose
+	// never frees the isolate under them.
+	lifetime   sync.RWMutex
+	disposed   int32
+	valueCount int64
+	handles    sync.Mutex
+	scripts    map[unsafe.Pointer]bool
+	contexts   map[unsafe.Pointer]bool
+
+	// Finalizers never lock the isolate, they queue the native objects
+	// here until a goroutine holding the engine frees them.
+	queued         int32
+	queuedValues   []unsafe.Pointer
+	queuedScripts  []unsafe.Pointer
+	queuedContexts []unsafe.Pointer
+	releasedData   []goHandle
+
+	// Template and accessor callbacks can be called until their
+	// template or the engine is disposed.
+	callbackHandles map[goHandle]bool
+
+	executorMutex sync.Mutex
+	executor      *Executor
+
+	// The callbacks inside FunctionCallbackInfo.Unlocked and the
+	// scopes they suspended, guarded by handles.
+	unlockedCount   int32
+	unlocked        map[unsafe.Pointer]bool
+	suspendedEpochs map[int64]bool
+}
+
+// The wrappers of an engine that were still alive when it was
+// disposed. Values are counted until their finalizer ran.
+//
+type LeakReport struct {
+	Values   int
+	Scripts  int
+	Contexts int
+}
+
+// Sets a function called with the panic value and the Go stack when a
+// callback called by JavaScript panics. The panic is then thrown into
+// JavaScript as an Error whose goPanic and goStack properties hold the
+// same information. Panics of the callbacks without a JavaScript caller,
+// weak callbacks, the near heap limit hook, message listeners, heap
+// snapshot writers and array buffer allocators, are only reported here.
+//
+func (e *Engine) SetPanicHandler(handler func(value interface{}, stack []byte)) {
+	hooksMutex.Lock()
+	e.hooks.panicHandler = handler
+	hooksMutex.Unlock()
+}
+
+// Returned by the error-returning run and call methods when the
+// script was terminated by the near heap limit hook.
+//
+var ErrOutOfMemory = errors.New("v8: out of memory")
+
+// Resource limits of an engine. Zero values keep the V8 defaults.
+// The sizes are in bytes, V8 takes them as int so they must stay below
+// 2 GB.
+//
+type EngineOptions struct {
+	MaxYoungSpace int
+	MaxOldSpace   int
+	MaxExecutable int
+
+	// Stack space JavaScript may use on each thread that enters a
+	// context scope, too deep recursion throws a RangeError.
+	StackLimit int
+
+	// Called after a GC when the used heap exceeds 90% of the heap
+	// limit. Returning true terminates the running script, and the
+	// error-returning methods report ErrOutOfMemory. When nil and a
+	// heap limit is set the script is always terminated.
+	// The hook runs inside the GC and must not use the engine.
+	NearHeapLimit func(used, limit int) bool
+
+	// Debug hook called by Dispose with the wrappers that were still
+	// alive, which usually means something kept them too long.
+	LeakReport func(LeakReport)
 }
 
 func NewEngine() *Engine {
-	self := C.V8_NewEngine()
+	return newEngine(nil, nil, nil)
+}
+
+// Creates an engine with the given resource limits. Panics when a
+// limit doesn't fit the int V8 takes.
+//
+func NewEngineWithOptions(options EngineOptions) *Engine {
+	checkLimit("MaxYoungSpace", options.MaxYoungSpace)
+	checkLimit("MaxOldSpace", options.MaxOldSpace)
+	checkLimit("MaxExecutable", options.MaxExecutable)
+	checkLimit("StackLimit", options.StackLimit)
+
+	nearHeapLimit := options.NearHeapLimit
+
+	if nearHeapLimit == nil && (options.MaxYoungSpace > 0 || options.MaxOldSpace > 0) {
+		nearHeapLimit = func(used, limit int) bool {
+			return true
+		}
+	}
+
+	cOptions := &C.V8_EngineOptions{
+		max_young_space: C.int(options.MaxYoungSpace),
+		max_old_space:   C.int(options.MaxOldSpace),
+		max_executable:  C.int(options.MaxExecutable),
+		stack_limit:     C.int(options.StackLimit),
+	}
+
+	return newEngine(cOptions, nearHeapLimit, options.LeakReport)
+}
+
+// The hooks of an engine that C calls without a context, they don't
+// hold the engine so its finalizer still runs.
+type engineHooks struct {
+	nearHeapLimit func(used, limit int) bool
+	panicHandler  func(value interface{}, stack []byte)
+}
+
+func checkLimit(name string, value int) {
+	if value < 0 || value > math.MaxInt32 {
+		panic("v8: EngineOptions." + name + " is out of range")
+	}
+}
+
+var (
+	hooksMutex sync.Mutex
+	hooksId    int
+	hooks      = make(map[int]*engineHooks)
+)
+
+func newEngine(options *C.V8_EngineOptions, nearHeapLimit func(used, limit int) bool, leakReport func(LeakReport)) *Engine {
+	if options == nil {
+		options = &C.V8_EngineOptions{}
+	}
+
+	engineHooks := &engineHooks{nearHeapLimit: nearHeapLimit}
+
+	// C looks the hooks up by id
+	hooksMutex.Lock()
+	hooksId += 1
+	hookId := hooksId
+	hooks[hookId] = engineHooks
+	hooksMutex.Unlock()
+
+	options.engine_id = C.int(hookId)
+	if nearHeapLimit != nil {
+		options.near_heap_limit = 1
+	}
+
+	self := C.V8_NewEngine(options)
 
 	if self == nil {
+		removeHooks(hookId)
 		return nil
 	}
 
@@ -36,19 +202,423 @@ func NewEngine() *Engine {
 		self:            self,
 		funcTemplates:   make(map[int]*FunctionTemplate),
 		objectTemplates: make(map[int]*ObjectTemplate),
+		hookId:          hookId,
+		hooks:           engineHooks,
+		leakReport:      leakReport,
+		scripts:         make(map[unsafe.Pointer]bool),
+		contexts:        make(map[unsafe.Pointer]bool),
+		callbackHandles: make(map[goHandle]bool),
 	}
 
 	runtime.SetFinalizer(result, func(e *Engine) {
-		if traceDispose {
-			println("v8.Engine.Dispose()", e.self)
-		}
-		C.V8_DisposeEngine(e.self)
+		e.Dispose()
 	})
 
 	return result
 }
 
-//export v8_panic
-func v8_panic(message *C.char) {
-	panic(C.GoString(message))
+// Frees the engine with its templates, contexts and scripts now
+// instead of waiting for the finalizers. Any later use of the engine
+// or of its values, scripts and contexts panics. It must not be called
+// inside a context scope of the engine.
+//
+func (e *Engine) Dispose() {
+	e.executorMutex.Lock()
+	executor := e.executor
+	e.executorMutex.Unlock()
+
+	if executor != nil {
+		executor.Close()
+	}
+
+	e.lifetime.Lock()
+	defer e.lifetime.Unlock()
+
+	if atomic.LoadInt32(&e.disposed) != 0 {
+		return
+	}
+
+	if e.leakReport != nil {
+		e.handles.Lock()
+		report := LeakReport{
+			Values:   int(atomic.LoadInt64(&e.valueCount)),
+			Scripts:  len(e.scripts),
+			Contexts: len(e.contexts),
+		}
+		e.handles.Unlock()
+		e.leakReport(report)
+	}
+
+	for _, ft := range e.funcTemplates {
+		ft.Dispose()
+	}
+
+	for _, ot := range e.objectTemplates {
+		ot.Dispose()
+	}
+
+	// Values finalized from now on are freed by their finalizer.
+	e.handles.Lock()
+	values, scripts, contexts := e.takeQueued()
+	for _, constant := range []*Value{e._undefined, e._null, e._true, e._false} {
+		if constant != nil {
+			values = append(values, constant.self)
+		}
+	}
+	for self := range e.scripts {
+		scripts = append(scripts, self)
+	}
+	for self := range e.contexts {
+		contexts = append(contexts, self)
+	}
+	e.scripts = nil
+	e.contexts = nil
+	atomic.StoreInt32(&e.disposed, 1)
+	e.handles.Unlock()
+
+	e.disposeHandles(values, scripts, contexts)
+
+	C.V8_DisposeEngine(e.self)
+	removeHooks(e.hookId)
+	e.removeWeakRefs()
+
+	e.handles.Lock()
+	for h := range e.callbackHandles {
+		h.delete()
+	}
+	e.callbackHandles = nil
+	e.handles.Unlock()
+
+	runtime.SetFinalizer(e, nil)
+}
+
+// Returned by the error-returning methods of a disposed engine.
+//
+var ErrEngineDisposed = errors.New("v8: engine is disposed")
+
+func (e *Engine) checkUsable() error {
+	if atomic.LoadInt32(&e.disposed) != 0 {
+		return ErrEngineDisposed
+	}
+	if e.IsDead() {
+		return ErrEngineDead
+	}
+	return nil
+}
+
+// Every wrapper belongs to the engine that created it, the V8 objects
+// of one isolate mean nothing to another one.
+//
+func (e *Engine) checkOwner(owner *Engine, what string) {
+	if owner != e {
+		panic("v8: " + what + " belongs to another engine")
+	}
+}
+
+// Returns the native engine, panicking once it was disposed.
+//
+func (e *Engine) ptr() unsafe.Pointer {
+	if atomic.LoadInt32(&e.disposed) != 0 {
+		panic("v8: engine is disposed")
+	}
+	return e.self
+}
+
+// Remembers a native object that Dispose must free.
+//
+func (e *Engine) track(handles *map[unsafe.Pointer]bool, self unsafe.Pointer) {
+	e.handles.Lock()
+	defer e.handles.Unlock()
+
+	if *handles != nil {
+		(*handles)[self] = true
+	}
+}
+
+// Used by the script and context finalizers, queues the native object
+// unless Dispose already freed it.
+//
+func (e *Engine) untrack(handles *map[unsafe.Pointer]bool, queue *[]unsafe.Pointer, self unsafe.Pointer) {
+	e.handles.Lock()
+	defer e.handles.Unlock()
+
+	if (*handles)[self] {
+		delete(*handles, self)
+		*queue = append(*queue, self)
+		atomic.StoreInt32(&e.queued, 1)
+	}
+}
+
+// Used by the value finalizer. Values don't need the isolate, so after
+// Dispose they are freed right away.
+//
+func (e *Engine) queueValue(self unsafe.Pointer) {
+	e.handles.Lock()
+	defer e.handles.Unlock()
+
+	if atomic.LoadInt32(&e.disposed) != 0 {
+		C.V8_DisposeValue(self)
+		return
+	}
+
+	e.queuedValues = append(e.queuedValues, self)
+	atomic.StoreInt32(&e.queued, 1)
+}
+
+// Registers a callback for C, it is released by deleteCallbackHandles
+// or Dispose.
+//
+func (e *Engine) newCallbackHandle(value interface{}) goHandle {
+	e.handles.Lock()
+	defer e.handles.Unlock()
+
+	if e.callbackHandles == nil {
+		panic("v8: engine is disposed")
+	}
+
+	h := newGoHandle(value)
+	e.callbackHandles[h] = true
+	return h
+}
+
+// Releases the callbacks of a disposed template.
+//
+func (e *Engine) deleteCallbackHandles(handles []goHandle) {
+	e.handles.Lock()
+	defer e.handles.Unlock()
+
+	for _, h := range handles {
+		delete(e.callbackHandles, h)
+		h.delete()
+	}
+}
+
+// Keeps the Go value of a dead wrapped object until the queue is
+// drained.
+//
+func (e *Engine) releaseData(data goHandle) {
+	e.handles.Lock()
+	defer e.handles.Unlock()
+
+	e.releasedData = append(e.releasedData, data)
+	atomic.StoreInt32(&e.queued, 1)
+}
+
+// Must be called with e.handles locked.
+func (e *Engine) takeQueued() (values, scripts, contexts []unsafe.Pointer) {
+	values, scripts, contexts = e.queuedValues, e.queuedScripts, e.queuedContexts
+	e.queuedValues, e.queuedScripts, e.queuedContexts = nil, nil, nil
+	for _, h := range e.releasedData {
+		h.delete()
+	}
+	e.releasedData = nil
+	atomic.StoreInt32(&e.queued, 0)
+	return
+}
+
+func (e *Engine) disposeHandles(values, scripts, contexts []unsafe.Pointer) {
+	if len(values) == 0 && len(scripts) == 0 && len(contexts) == 0 {
+		return
+	}
+
+	C.V8_Engine_DisposeHandles(e.self,
+		handleArray(values), C.int(len(values)),
+		handleArray(scripts), C.int(len(scripts)),
+		handleArray(contexts), C.int(len(contexts)),
+	)
+}
+
+func handleArray(handles []unsafe.Pointer) *unsafe.Pointer {
+	if len(handles) == 0 {
+		return nil
+	}
+	return &handles[0]
+}
+
+// Frees the values, scripts and contexts queued by the finalizers. It
+// is called on every context scope entry, so it's only needed for an
+// engine that is left idle while the Go GC collects its wrappers.
+//
+func (e *Engine) CollectGarbageHandles() {
+	e.ptr()
+	e.disposeQueued()
+}
+
+func (e *Engine) disposeQueued() {
+	if atomic.LoadInt32(&e.queued) == 0 {
+		return
+	}
+
+	e.lifetime.RLock()
+	defer e.lifetime.RUnlock()
+
+	if atomic.LoadInt32(&e.disposed) != 0 {
+		return
+	}
+
+	e.handles.Lock()
+	values, scripts, contexts := e.takeQueued()
+	e.handles.Unlock()
+
+	e.disposeHandles(values, scripts, contexts)
+}
+
+func removeHooks(id int) {
+	hooksMutex.Lock()
+	delete(hooks, id)
+	hooksMutex.Unlock()
+}
+
+// Returns nil for a disposed engine or a thread without one.
+//
+func lookupHooks(id C.int) *engineHooks {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+
+	return hooks[int(id)]
+}
+
+// Calls the panic handler, a panic of the handler itself is dropped.
+//
+func (h *engineHooks) report(value interface{}, stack []byte) {
+	hooksMutex.Lock()
+	handler := h.panicHandler
+	hooksMutex.Unlock()
+
+	if handler != nil {
+		defer func() { recover() }()
+		handler(value, stack)
+	}
+}
+
+// Deferred by the callbacks that have no JavaScript frame to throw
+// into, a panic must not unwind through V8. Without hooks the panic is
+// dropped.
+//
+func (h *engineHooks) recoverPanic() {
+	value := recover()
+	if value == nil || h == nil {
+		return
+	}
+
+	h.report(value, debug.Stack())
+}
+
+//export go_near_heap_limit
+func go_near_heap_limit(id C.int, used, limit C.size_t) C.int {
+	h := lookupHooks(id)
+	if h == nil || h.nearHeapLimit == nil {
+		return 0
+	}
+
+	// a panicking hook doesn't terminate the script
+	defer h.recoverPanic()
+
+	if h.nearHeapLimit(int(used), int(limit)) {
+		return 1
+	}
+	return 0
+}
+
+// Returned by the error-returning methods of an engine that hit a V8
+// fatal error.
+//
+var ErrEngineDead = errors.New("v8: engine is dead after a fatal error")
+
+var (
+	fatalErrorMutex   sync.Mutex
+	fatalErrorHandler func(location, message string)
+)
+
+// Sets a function called when V8 reports a fatal error, such as API
+// misuse, instead of aborting the process. The engine it happened in
+// is dead afterwards: IsDead returns true and the error-returning
+// methods return ErrEngineDead, so a supervisor can replace it.
+// Out of memory errors are reported too but still abort the process
+// when the handler returns, use EngineOptions to avoid them.
+//
+func SetFatalErrorHandler(handler func(location, message string)) {
+	fatalErrorMutex.Lock()
+	fatalErrorHandler = handler
+	fatalErrorMutex.Unlock()
+}
+
+//export go_fatal_error
+func go_fatal_error(location, message *C.char) {
+	fatalErrorMutex.Lock()
+	handler := fatalErrorHandler
+	fatalErrorMutex.Unlock()
+
+	if handler == nil {
+		return
+	}
+
+	// must not unwind through the V8 frames
+	defer func() { recover() }()
+
+	handler(C.GoString(location), C.GoString(message))
+}
+
+// Reports whether the engine hit a V8 fatal error.
+//
+func (e *Engine) IsDead() bool {
+	return C.V8_IsDead(e.ptr()) != 0
+}
+
+// Misuse detected on the C side is reported here, once the C frames
+// returned and the isolate is unlocked.
+//
+func (e *Engine) checkAPIError() {
+	if message := C.V8_Engine_TakeAPIError(e.ptr()); message != nil {
+		panic(C.GoString(message))
+	}
+}
+
+// Heap usage of an engine in bytes.
+//
+type HeapStatistics struct {
+	TotalHeapSize           int
+	TotalHeapSizeExecutable int
+	TotalPhysicalSize       int
+	UsedHeapSize            int
+	HeapSizeLimit           int
+}
+
+// Usage of a single heap space in bytes.
+//
+type HeapSpaceStatistics struct {
+	SpaceName          string
+	SpaceSize          int
+	SpaceUsedSize      int
+	SpaceAvailableSize int
+	PhysicalSpaceSize  int
+}
+
+// Returned by APIs which the linked V8 version doesn't provide.
+//
+var ErrNotSupported = errors.New("v8: not supported by this V8 version")
+
+// Returns the heap statistics as of the last GC or the last exit of an
+// outermost context scope. The engine is not locked, so it can be
+// called from any goroutine while another one is running scripts.
+//
+func (e *Engine) HeapStatistics() HeapStatistics {
+	var stats C.V8_HeapStatistics
+
+	C.V8_Engine_HeapStatistics(e.ptr(), &stats)
+
+	return HeapStatistics{
+		TotalHeapSize:           int(stats.total_heap_size),
+		TotalHeapSizeExecutable: int(stats.total_heap_size_executable),
+		TotalPhysicalSize:       int(stats.total_physical_size),
+		UsedHeapSize:            int(stats.used_heap_size),
+		HeapSizeLimit:           int(stats.heap_size_limit),
+	}
+}
+
+// Per space statistics need Isolate::GetHeapSpaceStatistics, which
+// this V8 version doesn't have, so it always returns ErrNotSupported.
+//
+func (e *Engine) HeapSpaceStatistics() ([]HeapSpaceStatistics, error) {
+	return nil, ErrNotSupported
 }
@@ -0,0 +1,112 @@
+package v8
+
+/*
+#include "v8_wrap.h"
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+
+// A JavaScript exception caught by ContextScope.TryCatchError.
+//
+// The location fields come from the exception's message and are zero
+// when V8 has no message for it. StackTrace is only filled after
+// SetCaptureStackTraceForUncaughtExceptions(true, ...) has been called.
+//
+type JSError struct {
+	Value              *Value
+	Message            string
+	ScriptResourceName string
+	LineNumber         int
+	StartColumn        int
+	EndColumn          int
+	SourceLine         string
+	StackTrace         []StackFrame
+	report             string
+	terminated         bool
+	outOfMemory        bool
+}
+
+// A single JavaScript stack frame of a JSError.
+//
+type StackFrame struct {
+	Function      string
+	Script        string
+	Line          int
+	Column        int
+	IsEval        bool
+	IsConstructor bool
+}
+
+// Returns the same report as ContextScope.TryCatch(false, ...).
+//
+func (e *JSError) Error() string {
+	return e.report
+}
+
+func newJSError(e *Engine, exception *C.V8_Exception) *JSError {
+	defer C.V8_DisposeException(exception)
+
+	err := &JSError{
+		Value:              newValue(e, exception.exception),
+		Message:            C.GoString(exception.message),
+		ScriptResourceName: C.GoString(exception.resource_name),
+		LineNumber:         int(exception.line),
+		StartColumn:        int(exception.start_column),
+		EndColumn:          int(exception.end_column),
+		SourceLine:         C.GoString(exception.source_line),
+		report:             C.GoString(exception.report),
+		terminated:         exception.terminated != 0,
+		outOfMemory:        exception.out_of_memory != 0,
+	}
+
+	if count := int(exception.frame_count); count > 0 {
+		frames := (*[1 << 20]C.V8_StackFrame)(unsafe.Pointer(exception.frames))[:count:count]
+		err.StackTrace = make([]StackFrame, count)
+		for i, frame := range frames {
+			err.StackTrace[i] = StackFrame{
+				Function:      C.GoString(frame.function),
+				Script:        C.GoString(frame.script),
+				Line:          int(frame.line),
+				Column:        int(frame.column),
+				IsEval:        frame.is_eval != 0,
+				IsConstructor: frame.is_constructor != 0,
+			}
+		}
+	}
+
+	return err
+}
+
+// Converts a caught exception into the error of the error-returning
+// methods.
+//
+func exceptionError(e *Engine, exception *C.V8_Exception) error {
+	err := newJSError(e, exception)
+	if err.outOfMemory {
+		return ErrOutOfMemory
+	}
+	return err
+}
+
+// Like TryCatch but returns the caught exception as a *JSError, or
+// nil when the callback didn't throw.
+//
+func (cs ContextScope) TryCatchError(callback func()) error {
+	var p goPanic
+	wrapped := func() {
+		defer p.recover()
+		callback()
+	}
+	self := cs.ptr()
+	callbackHandle := newGoHandle(wrapped)
+	exception := C.V8_Context_TryCatchException(self, callbackHandle.c())
+	callbackHandle.delete()
+	if exception == nil {
+		p.repanic()
+		return nil
+	}
+	err := exceptionError(cs.context.engine, exception)
+	p.repanic()
+	return err
+}
@@ -0,0 +1,272 @@
+package v8
+
+/*
+#include "v8_wrap.h"
+*/
+import "C"
+import "errors"
+import "fmt"
+import "runtime/debug"
+import "sync"
+import "sync/atomic"
+
+// Returned for work submitted to a closed executor.
+//
+var ErrExecutorClosed = errors.New("v8: executor is closed")
+
+// Runs the work of an engine on one OS thread, so the isolate lock is
+// never handed between threads. Work is submitted as closures from any
+// goroutine and runs one at a time in submission order, in its own
+// handle scope of the executor's context. The executor keeps a scope of
+// the context open on its thread until it is closed and only unlocks
+// the isolate while it waits for work.
+//
+type Executor struct {
+	engine  *Engine
+	context *Context
+	ready   chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+	close   sync.Once
+
+	// the queue has no limit, so Go never waits for the running work
+	mutex  sync.Mutex
+	queue  []executorJob
+	closed bool
+}
+
+type executorJob struct {
+	work   func(ContextScope)
+	result chan Result
+}
+
+// The outcome of work submitted with Executor.Go.
+//
+type Result struct {
+	// ErrExecutorClosed when the work never ran, a *PanicError when
+	// it panicked.
+	Err error
+}
+
+// A panic of executor work, with the Go stack where it happened.
+//
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("v8: executor work panicked: %v", e.Value)
+}
+
+// Returns the executor of the engine, starting it on first use. Using
+// the engine from other goroutines directly still works, they just
+// compete with the executor for the isolate.
+//
+func (e *Engine) Executor() *Executor {
+	e.executorMutex.Lock()
+	defer e.executorMutex.Unlock()
+
+	if e.executor == nil {
+		x := &Executor{
+			engine:  e,
+			context: e.NewContext(nil),
+			ready:   make(chan struct{}, 1),
+			quit:    make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		go x.run()
+		e.executor = x
+	}
+
+	return e.executor
+}
+
+func (x *Executor) run() {
+	defer close(x.done)
+
+	// Enter pins the executor to its thread until Exit
+	cs, err := x.context.Enter()
+	if err == nil {
+		defer cs.Exit()
+	}
+
+	for x.wait(cs, err) {
+		for {
+			job, ok := x.next()
+			if !ok {
+				break
+			}
+			if err != nil {
+				job.result <- Result{err}
+				continue
+			}
+			job.result <- x.runJob(cs, job.work)
+		}
+	}
+}
+
+// Waits for work with the isolate unlocked, so other goroutines can use
+// the engine meanwhile. False once the executor is closed.
+//
+func (x *Executor) wait(cs ContextScope, err error) (ok bool) {
+	wait := func() {
+		select {
+		case <-x.ready:
+			ok = true
+		case <-x.quit:
+		}
+	}
+
+	// without a scope there is nothing to unlock
+	if err != nil {
+		wait()
+		return
+	}
+
+	x.engine.runUnlocked(cs.context, nil, wait)
+	return
+}
+
+func (x *Executor) next() (executorJob, bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.closed || len(x.queue) == 0 {
+		return executorJob{}, false
+	}
+
+	job := x.queue[0]
+	x.queue[0] = executorJob{}
+	x.queue = x.queue[1:]
+	return job, true
+}
+
+func (x *Executor) runJob(cs ContextScope, work func(ContextScope)) (result Result) {
+	e := x.engine
+	if result.Err = e.checkUsable(); result.Err != nil {
+		return
+	}
+
+	defer func() {
+		if value := recover(); value != nil {
+			result.Err = &PanicError{value, debug.Stack()}
+		}
+	}()
+
+	e.disposeQueued()
+	cs.HandleScope(func(HandleScope) {
+		// like Scope, exits the scopes the work left open
+		entered := e.entered
+		defer func() {
+			if e.entered != entered {
+				for e.entered != entered {
+					e.exitEntered()
+				}
+				panic("v8: context scope opened by Enter was not exited")
+			}
+		}()
+
+		work(cs)
+	})
+	return
+}
+
+// Whether the calling goroutine holds the isolate, as executor work and
+// other scopes of the engine do. Waiting for the executor there would
+// wait for the isolate the caller holds.
+//
+func (x *Executor) lockedByCaller() bool {
+	// Dispose closed the executor already
+	if atomic.LoadInt32(&x.engine.disposed) != 0 {
+		return false
+	}
+	return C.V8_IsLockedByThread(x.engine.self) != 0
+}
+
+// Runs the work on the executor thread and waits for it. A panic of
+// the work is raised again in the caller. Called inside a scope of the
+// engine, including by executor work, the work runs right away on the
+// calling thread instead, waiting would deadlock. Work inside Unlocked
+// must not call Do.
+//
+func (x *Executor) Do(work func(ContextScope)) error {
+	if x.lockedByCaller() {
+		x.mutex.Lock()
+		closed := x.closed
+		x.mutex.Unlock()
+
+		if closed {
+			return ErrExecutorClosed
+		}
+		return x.context.ScopeE(func(cs ContextScope) error {
+			work(cs)
+			return nil
+		})
+	}
+
+	result := <-x.Go(work)
+
+	if p, ok := result.Err.(*PanicError); ok {
+		panic(p.Value)
+	}
+
+	return result.Err
+}
+
+// Queues the work for the executor thread and returns at once, so it
+// can be called by executor work too. The channel receives the result
+// once the work ran, it is buffered so it can be ignored.
+//
+func (x *Executor) Go(work func(ContextScope)) <-chan Result {
+	result := make(chan Result, 1)
+
+	x.mutex.Lock()
+	if x.closed {
+		x.mutex.Unlock()
+		result <- Result{ErrExecutorClosed}
+		return result
+	}
+	x.queue = append(x.queue, executorJob{work, result})
+	x.mutex.Unlock()
+
+	select {
+	case x.ready <- struct{}{}:
+	default:
+	}
+
+	return result
+}
+
+// Stops the executor once the running work returned, queued work that
+// didn't start and work submitted afterwards get ErrExecutorClosed. The
+// next call of Engine.Executor starts a new one. Dispose closes the
+// executor of the engine. Panics inside a scope of the engine, it would
+// wait for the isolate the caller holds.
+//
+func (x *Executor) Close() {
+	if x.lockedByCaller() {
+		panic("v8: executor closed inside a scope of its engine")
+	}
+
+	x.close.Do(func() {
+		x.mutex.Lock()
+		x.closed = true
+		queued := x.queue
+		x.queue = nil
+		x.mutex.Unlock()
+
+		for _, job := range queued {
+			job.result <- Result{ErrExecutorClosed}
+		}
+		close(x.quit)
+	})
+	<-x.done
+
+	e := x.engine
+	e.executorMutex.Lock()
+	if e.executor == x {
+		e.executor = nil
+	}
+	e.executorMutex.Unlock()
+}
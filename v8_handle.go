@@ -0,0 +1,69 @@
+package v8
+
+/*
+#include "v8_wrap.h"
+*/
+import "C"
+import "sync"
+
+// The cgo rules don't allow C to keep Go pointers, so callbacks and
+// data are registered here and C only stores the handle number, the
+// same idea as runtime/cgo.Handle. Zero is never a valid handle, C
+// uses it for a missing callback.
+//
+type goHandle uintptr
+
+var goHandles = struct {
+	sync.RWMutex
+	last   goHandle
+	values map[goHandle]interface{}
+}{
+	values: make(map[goHandle]interface{}),
+}
+
+func newGoHandle(value interface{}) goHandle {
+	goHandles.Lock()
+	defer goHandles.Unlock()
+
+	goHandles.last += 1
+	h := goHandles.last
+	goHandles.values[h] = value
+
+	return h
+}
+
+func (h goHandle) value() interface{} {
+	value, ok := h.lookup()
+	if !ok {
+		panic("v8: invalid Go handle")
+	}
+
+	return value
+}
+
+func (h goHandle) lookup() (interface{}, bool) {
+	goHandles.RLock()
+	defer goHandles.RUnlock()
+
+	value, ok := goHandles.values[h]
+	return value, ok
+}
+
+func (h goHandle) delete() {
+	goHandles.Lock()
+	delete(goHandles.values, h)
+	goHandles.Unlock()
+}
+
+func (h goHandle) c() C.V8_GoHandle {
+	return C.V8_GoHandle(h)
+}
+
+// Returns zero for a callback that isn't set, so C can skip it.
+//
+func (h goHandle) cIf(set bool) C.V8_GoHandle {
+	if !set {
+		return 0
+	}
+	return h.c()
+}
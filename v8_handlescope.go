@@ -0,0 +1,106 @@
+package v8
+
+/*
+#include "v8_wrap.h"
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+import "sync/atomic"
+
+// A context scope whose values are released all at once when the
+// handle scope ends, instead of one by one by their finalizers. Using
+// such a value afterwards panics unless it was escaped.
+//
+type HandleScope struct {
+	ContextScope
+}
+
+type handleScope struct {
+	self   unsafe.Pointer
+	prev   *handleScope
+	values []*Value
+}
+
+func (s *handleScope) add(v *Value) {
+	v.scope = s
+	s.values = append(s.values, v)
+}
+
+// Runs the callback in a new handle scope. Values created by the
+// callback, on any object of the engine, belong to the handle scope
+// until it ends or they are escaped. Handle scopes can be nested.
+//
+func (cs ContextScope) HandleScope(callback func(HandleScope)) {
+	e := cs.context.engine
+	scope := &handleScope{prev: e.handleScope}
+
+	var p goPanic
+	wrapped := func(self unsafe.Pointer) {
+		defer p.recover()
+
+		scope.self = self
+		e.handleScope = scope
+		defer func() {
+			e.handleScope = scope.prev
+		}()
+
+		callback(HandleScope{cs})
+	}
+
+	self := cs.ptr()
+	callbackHandle := newGoHandle(wrapped)
+	C.V8_HandleScope(self, callbackHandle.c())
+	callbackHandle.delete()
+
+	scope.release()
+	p.repanic()
+}
+
+//export handle_scope_callback
+func handle_scope_callback(callback C.V8_GoHandle, scope unsafe.Pointer) {
+	goHandle(callback).value().(func(unsafe.Pointer))(scope)
+}
+
+func (s *handleScope) release() {
+	values := make([]unsafe.Pointer, 0, len(s.values))
+
+	for _, v := range s.values {
+		if v.scope == s {
+			values = append(values, v.self)
+			v.self = nil
+			v.scope = nil
+		}
+	}
+
+	if len(values) > 0 {
+		C.V8_DisposeValues(&values[0], C.int(len(values)))
+		atomic.AddInt64(&s.values[0].engine.valueCount, -int64(len(values)))
+	}
+
+	s.values = nil
+}
+
+// Moves the value out of its handle scope into the enclosing one, or
+// back to finalizer based release when there is none. Values created
+// outside handle scopes are returned as is.
+//
+func (v *Value) Escape() *Value {
+	self := v.ptr()
+	scope := v.scope
+
+	if scope == nil {
+		return v
+	}
+
+	C.V8_HandleScope_Escape(scope.self, self)
+
+	if scope.prev != nil {
+		scope.prev.add(v)
+	} else {
+		v.scope = nil
+		v.setFinalizer()
+	}
+
+	return v
+}
@@ -0,0 +1,231 @@
+package v8
+
+/*
+#include "v8_wrap.h"
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "runtime/debug"
+import "strconv"
+
+type heapSnapshotWriter struct {
+	w     io.Writer
+	err   error
+	hooks *engineHooks
+}
+
+// Takes a heap snapshot and streams it to w in the JSON format of
+// Chrome DevTools (.heapsnapshot). The engine is locked while writing,
+// so w must not use the engine. A panic of w stops the snapshot, it is
+// reported to the panic handler and returned as an error.
+//
+func (e *Engine) TakeHeapSnapshot(w io.Writer) error {
+	writer := &heapSnapshotWriter{w: w, hooks: e.hooks}
+	self := e.ptr()
+	writerHandle := newGoHandle(writer)
+	defer writerHandle.delete()
+
+	if C.V8_TakeHeapSnapshot(self, writerHandle.c()) == 0 {
+		return errors.New("v8: taking heap snapshot failed")
+	}
+
+	return writer.err
+}
+
+//export go_output_stream_write
+func go_output_stream_write(writer C.V8_GoHandle, data *C.char, size C.int) (result C.int) {
+	w := goHandle(writer).value().(*heapSnapshotWriter)
+
+	defer func() {
+		if value := recover(); value != nil {
+			w.err = fmt.Errorf("v8: heap snapshot writer panicked: %v", value)
+			w.hooks.report(value, debug.Stack())
+			result = 0
+		}
+	}()
+
+	if _, err := w.w.Write(C.GoBytes(unsafe.Pointer(data), size)); err != nil {
+		w.err = err
+		return 0
+	}
+
+	return 1
+}
+
+// A parsed heap snapshot. Nodes[0] is the synthetic root.
+//
+type HeapSnapshot struct {
+	Nodes []HeapNode
+	Edges []HeapEdge
+}
+
+// A heap object. For objects Name is the constructor name.
+//
+type HeapNode struct {
+	Type     string
+	Name     string
+	Id       int
+	SelfSize int
+	Edges    []HeapEdge
+}
+
+// A reference from one heap object to another. Name is the property
+// name, or the index for element and hidden edges.
+//
+type HeapEdge struct {
+	Type string
+	Name string
+	From *HeapNode
+	To   *HeapNode
+}
+
+type heapSnapshotJSON struct {
+	Snapshot struct {
+		Meta struct {
+			NodeFields []string          `json:"node_fields"`
+			NodeTypes  []json.RawMessage `json:"node_types"`
+			EdgeFields []string          `json:"edge_fields"`
+			EdgeTypes  []json.RawMessage `json:"edge_types"`
+		} `json:"meta"`
+	} `json:"snapshot"`
+	Nodes   []int    `json:"nodes"`
+	Edges   []int    `json:"edges"`
+	Strings []string `json:"strings"`
+}
+
+// Reads a snapshot written by TakeHeapSnapshot.
+//
+func ParseHeapSnapshot(r io.Reader) (*HeapSnapshot, error) {
+	var raw heapSnapshotJSON
+
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	meta := raw.Snapshot.Meta
+
+	nodeFields, err := fieldIndexes(meta.NodeFields, "type", "name", "id", "self_size", "edge_count")
+	if err != nil {
+		return nil, err
+	}
+
+	edgeFields, err := fieldIndexes(meta.EdgeFields, "type", "name_or_index", "to_node")
+	if err != nil {
+		return nil, err
+	}
+
+	var nodeTypes, edgeTypes []string
+
+	if len(meta.NodeTypes) == 0 || json.Unmarshal(meta.NodeTypes[0], &nodeTypes) != nil {
+		return nil, errors.New("v8: heap snapshot has no node types")
+	}
+
+	if len(meta.EdgeTypes) == 0 || json.Unmarshal(meta.EdgeTypes[0], &edgeTypes) != nil {
+		return nil, errors.New("v8: heap snapshot has no edge types")
+	}
+
+	nodeFieldCount := len(meta.NodeFields)
+	edgeFieldCount := len(meta.EdgeFields)
+
+	if len(raw.Nodes)%nodeFieldCount != 0 || len(raw.Edges)%edgeFieldCount != 0 {
+		return nil, errors.New("v8: heap snapshot is truncated")
+	}
+
+	snapshot := &HeapSnapshot{
+		Nodes: make([]HeapNode, len(raw.Nodes)/nodeFieldCount),
+		Edges: make([]HeapEdge, len(raw.Edges)/edgeFieldCount),
+	}
+
+	lookup := func(table []string, index int) (string, error) {
+		if index < 0 || index >= len(table) {
+			return "", fmt.Errorf("v8: heap snapshot index %d out of range", index)
+		}
+		return table[index], nil
+	}
+
+	edge := 0
+
+	for i := range snapshot.Nodes {
+		fields := raw.Nodes[i*nodeFieldCount:]
+		node := &snapshot.Nodes[i]
+
+		if node.Type, err = lookup(nodeTypes, fields[nodeFields[0]]); err != nil {
+			return nil, err
+		}
+		if node.Name, err = lookup(raw.Strings, fields[nodeFields[1]]); err != nil {
+			return nil, err
+		}
+		node.Id = fields[nodeFields[2]]
+		node.SelfSize = fields[nodeFields[3]]
+
+		count := fields[nodeFields[4]]
+		if count < 0 || edge+count > len(snapshot.Edges) {
+			return nil, errors.New("v8: heap snapshot edge count out of range")
+		}
+
+		node.Edges = snapshot.Edges[edge : edge+count : edge+count]
+
+		for j := range node.Edges {
+			fields := raw.Edges[(edge+j)*edgeFieldCount:]
+			e := &node.Edges[j]
+
+			if e.Type, err = lookup(edgeTypes, fields[edgeFields[0]]); err != nil {
+				return nil, err
+			}
+
+			if nameOrIndex := fields[edgeFields[1]]; e.Type == "element" || e.Type == "hidden" {
+				e.Name = strconv.Itoa(nameOrIndex)
+			} else if e.Name, err = lookup(raw.Strings, nameOrIndex); err != nil {
+				return nil, err
+			}
+
+			to := fields[edgeFields[2]]
+			if to < 0 || to%nodeFieldCount != 0 || to/nodeFieldCount >= len(snapshot.Nodes) {
+				return nil, errors.New("v8: heap snapshot edge target out of range")
+			}
+
+			e.From = node
+			e.To = &snapshot.Nodes[to/nodeFieldCount]
+		}
+
+		edge += count
+	}
+
+	return snapshot, nil
+}
+
+func fieldIndexes(fields []string, names ...string) ([]int, error) {
+	indexes := make([]int, len(names))
+
+NAMES:
+	for i, name := range names {
+		for j, field := range fields {
+			if field == name {
+				indexes[i] = j
+				continue NAMES
+			}
+		}
+		return nil, fmt.Errorf("v8: heap snapshot has no %q field", name)
+	}
+
+	return indexes, nil
+}
+
+// Counts the objects in the snapshot by constructor name.
+//
+func (s *HeapSnapshot) ObjectCounts() map[string]int {
+	counts := make(map[string]int)
+
+	for i := range s.Nodes {
+		if s.Nodes[i].Type == "object" {
+			counts[s.Nodes[i].Name]++
+		}
+	}
+
+	return counts
+}
@@ -0,0 +1,750 @@
+package v8
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An UnsupportedTypeError is returned by NewValue when it meets a Go
+// type that has no JavaScript counterpart, such as a channel or a
+// function.
+//
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "v8: unsupported type: " + e.Type.String()
+}
+
+// An UnmarshalTypeError is returned by Value.Unmarshal when a
+// JavaScript value does not fit the Go value it should be stored in.
+// Path locates the value inside the unmarshaled data, for example
+// "config.servers[2].port".
+//
+type UnmarshalTypeError struct {
+	Path     string
+	Expected string
+	Got      string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Path == "" {
+		return "expected " + e.Expected + ", got " + e.Got
+	}
+	return e.Path + ": expected " + e.Expected + ", got " + e.Got
+}
+
+// An UnmarshalCycleError is returned by Value.Unmarshal when an object
+// contains itself, Go values can't hold the cycle.
+//
+type UnmarshalCycleError struct {
+	Path string
+}
+
+func (e *UnmarshalCycleError) Error() string {
+	if e.Path == "" {
+		return "v8: cyclic value"
+	}
+	return "v8: cyclic value at " + e.Path
+}
+
+// A MarshalCycleError is returned by NewValue when a Go value contains
+// itself through a pointer, map or slice.
+//
+type MarshalCycleError struct {
+	Type reflect.Type
+}
+
+func (e *MarshalCycleError) Error() string {
+	return "v8: cyclic value of type " + e.Type.String()
+}
+
+// An InvalidUnmarshalError is returned by Value.Unmarshal when the
+// destination is not a non-nil pointer.
+//
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "v8: Unmarshal(nil)"
+	}
+	return "v8: Unmarshal(non-pointer " + e.Type.String() + ")"
+}
+
+// Returned by NewValue for a *Value that belongs to another engine.
+//
+var ErrEngineMismatch = errors.New("v8: value belongs to another engine")
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	valueType = reflect.TypeOf((*Value)(nil))
+)
+
+// Converts a Go value into a JavaScript value.
+//
+// Booleans, integers, floats and strings map to their JavaScript
+// primitives, []byte becomes a string, slices and arrays become
+// arrays, maps with string keys and structs become objects and
+// time.Time becomes a Date. Nil pointers, slices, maps and interfaces
+// become null. Values that are already a *Value (or *Object, *Array,
+// *Function, *RegExp) of the same engine are passed through unchanged.
+//
+// Struct fields are named after the field unless a `js:"name"` tag is
+// given. The "omitempty" option skips empty fields and a tag of "-"
+// skips the field entirely. Unexported fields are ignored. Values that
+// contain themselves return a MarshalCycleError.
+//
+func (cs ContextScope) NewValue(value interface{}) (*Value, error) {
+	return cs.marshal(reflect.ValueOf(value), make(map[visit]bool))
+}
+
+// A pointer, map or slice being marshaled. Slices are told apart by
+// their length too, a slice may share its array with a shorter one.
+//
+type visit struct {
+	ptr    uintptr
+	length int
+	typ    reflect.Type
+}
+
+// Adds the pointer, map or slice rv to the values being marshaled,
+// false when it is one of them already.
+//
+func enterVisit(visiting map[visit]bool, rv reflect.Value) (visit, bool) {
+	key := visit{rv.Pointer(), 0, rv.Type()}
+	if rv.Kind() == reflect.Slice {
+		key.length = rv.Len()
+	}
+	if visiting[key] {
+		return key, false
+	}
+	visiting[key] = true
+	return key, true
+}
+
+func (cs ContextScope) marshal(rv reflect.Value, visiting map[visit]bool) (*Value, error) {
+	if !rv.IsValid() {
+		return cs.context.engine.Null(), nil
+	}
+
+	if rv.CanInterface() {
+		switch v := rv.Interface().(type) {
+		case *Value:
+			return cs.passValue(v)
+		case *Object:
+			if v == nil {
+				return cs.context.engine.Null(), nil
+			}
+			return cs.passValue(v.Value)
+		case *Array:
+			if v == nil {
+				return cs.context.engine.Null(), nil
+			}
+			return cs.passValue(v.Value)
+		case *Function:
+			if v == nil {
+				return cs.context.engine.Null(), nil
+			}
+			return cs.passValue(v.Value)
+		case *RegExp:
+			if v == nil {
+				return cs.context.engine.Null(), nil
+			}
+			return cs.passValue(v.Value)
+		case time.Time:
+			return cs.NewDate(v), nil
+		}
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return cs.NewBoolean(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cs.NewInteger(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return cs.NewNumber(float64(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return cs.NewNumber(rv.Float()), nil
+	case reflect.String:
+		return cs.NewString(rv.String()), nil
+	case reflect.Slice:
+		if rv.IsNil() {
+			return cs.context.engine.Null(), nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return cs.NewString(string(rv.Bytes())), nil
+		}
+		key, ok := enterVisit(visiting, rv)
+		if !ok {
+			return nil, &MarshalCycleError{rv.Type()}
+		}
+		defer delete(visiting, key)
+		return cs.marshalArray(rv, visiting)
+	case reflect.Array:
+		return cs.marshalArray(rv, visiting)
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, &UnsupportedTypeError{rv.Type()}
+		}
+		if rv.IsNil() {
+			return cs.context.engine.Null(), nil
+		}
+		key, ok := enterVisit(visiting, rv)
+		if !ok {
+			return nil, &MarshalCycleError{rv.Type()}
+		}
+		defer delete(visiting, key)
+		return cs.marshalMap(rv, visiting)
+	case reflect.Struct:
+		return cs.marshalStruct(rv, visiting)
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return cs.context.engine.Null(), nil
+		}
+		key, ok := enterVisit(visiting, rv)
+		if !ok {
+			return nil, &MarshalCycleError{rv.Type()}
+		}
+		defer delete(visiting, key)
+		return cs.marshal(rv.Elem(), visiting)
+	case reflect.Interface:
+		if rv.IsNil() {
+			return cs.context.engine.Null(), nil
+		}
+		return cs.marshal(rv.Elem(), visiting)
+	}
+
+	return nil, &UnsupportedTypeError{rv.Type()}
+}
+
+func (cs ContextScope) passValue(v *Value) (*Value, error) {
+	if v == nil {
+		return cs.context.engine.Null(), nil
+	}
+	if v.engine != cs.context.engine {
+		return nil, ErrEngineMismatch
+	}
+	return v, nil
+}
+
+func (cs ContextScope) marshalArray(rv reflect.Value, visiting map[visit]bool) (*Value, error) {
+	length := rv.Len()
+	array := cs.NewArray(length)
+
+	for i := 0; i < length; i++ {
+		elem, err := cs.marshal(rv.Index(i), visiting)
+		if err != nil {
+			return nil, err
+		}
+		array.SetElement(i, elem)
+	}
+
+	return array.Value, nil
+}
+
+func (cs ContextScope) marshalMap(rv reflect.Value, visiting map[visit]bool) (*Value, error) {
+	keys := make([]string, 0, rv.Len())
+	for _, key := range rv.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+
+	value := cs.NewObject()
+	object := value.ToObject()
+	keyType := rv.Type().Key()
+
+	for _, key := range keys {
+		prop, err := cs.marshal(rv.MapIndex(reflect.ValueOf(key).Convert(keyType)), visiting)
+		if err != nil {
+			return nil, err
+		}
+		object.SetProperty(key, prop, PA_None)
+	}
+
+	return value, nil
+}
+
+func (cs ContextScope) marshalStruct(rv reflect.Value, visiting map[visit]bool) (*Value, error) {
+	value := cs.NewObject()
+	object := value.ToObject()
+
+	for _, field := range structFields(rv.Type()) {
+		fv, ok := fieldByIndex(rv, field.index, false)
+		if !ok {
+			continue
+		}
+
+		if field.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+
+		prop, err := cs.marshal(fv, visiting)
+		if err != nil {
+			return nil, err
+		}
+		object.SetProperty(field.name, prop, PA_None)
+	}
+
+	return value, nil
+}
+
+// Stores a JavaScript value into the Go value pointed to by dst,
+// following the same rules as NewValue in reverse. It mirrors the
+// semantics of encoding/json: null and undefined leave the
+// destination untouched (but clear pointers, maps, slices and
+// interfaces), properties are matched to struct fields by name,
+// preferring an exact match over a case-insensitive one, properties
+// without a matching struct field are ignored and numbers are checked against the range of integer and
+// float32 destinations. Dates can be stored into time.Time and any
+// value can be stored into a *Value. An empty interface receives
+// nil, bool, float64, string, time.Time, []interface{} or
+// map[string]interface{}. Objects that contain themselves can't be
+// stored and return an UnmarshalCycleError.
+//
+func (v *Value) Unmarshal(dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(dst)}
+	}
+	return unmarshal(v, rv.Elem(), "", nil)
+}
+
+// The objects from the root down to the value being unmarshaled.
+//
+type ancestor struct {
+	value *Value
+	hash  int
+}
+
+// Adds v to the ancestors, false when it is one of them already.
+//
+func enterAncestor(ancestors []ancestor, v *Value) ([]ancestor, bool) {
+	hash := v.ToObject().identityHash()
+	for _, a := range ancestors {
+		if a.hash == hash && a.value.strictEquals(v) {
+			return nil, false
+		}
+	}
+	return append(ancestors, ancestor{v, hash}), true
+}
+
+func unmarshal(v *Value, rv reflect.Value, path string, ancestors []ancestor) error {
+	if rv.Type() == valueType {
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+
+	if v.IsNull() || v.IsUndefined() {
+		switch rv.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			rv.Set(reflect.Zero(rv.Type()))
+		}
+		return nil
+	}
+
+	if rv.Type() == timeType {
+		if !v.IsDate() {
+			return &UnmarshalTypeError{path, "date", jsTypeOf(v)}
+		}
+		t, ok := toTime(v)
+		if !ok {
+			return &UnmarshalTypeError{path, "date", "invalid date"}
+		}
+		rv.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	// pointers and interfaces store the same value again
+	if v.IsObject() && rv.Kind() != reflect.Ptr && rv.Kind() != reflect.Interface {
+		var ok bool
+		if ancestors, ok = enterAncestor(ancestors, v); !ok {
+			return &UnmarshalCycleError{path}
+		}
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return unmarshal(v, rv.Elem(), path, ancestors)
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return &UnmarshalTypeError{path, rv.Type().String(), jsTypeOf(v)}
+		}
+		value, err := toInterface(v, path, ancestors)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(value))
+	case reflect.Bool:
+		if !v.IsBoolean() {
+			return &UnmarshalTypeError{path, "boolean", jsTypeOf(v)}
+		}
+		rv.SetBool(v.IsTrue())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !v.IsNumber() {
+			return &UnmarshalTypeError{path, "number", jsTypeOf(v)}
+		}
+		n := v.ToNumber()
+		if n != math.Trunc(n) || n < -1<<63 || n >= 1<<63 || rv.OverflowInt(int64(n)) {
+			return &UnmarshalTypeError{path, rv.Type().String(), "number " + formatNumber(n)}
+		}
+		rv.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if !v.IsNumber() {
+			return &UnmarshalTypeError{path, "number", jsTypeOf(v)}
+		}
+		n := v.ToNumber()
+		if n != math.Trunc(n) || n < 0 || n >= 1<<64 || rv.OverflowUint(uint64(n)) {
+			return &UnmarshalTypeError{path, rv.Type().String(), "number " + formatNumber(n)}
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		if !v.IsNumber() {
+			return &UnmarshalTypeError{path, "number", jsTypeOf(v)}
+		}
+		n := v.ToNumber()
+		if rv.OverflowFloat(n) {
+			return &UnmarshalTypeError{path, rv.Type().String(), "number " + formatNumber(n)}
+		}
+		rv.SetFloat(n)
+	case reflect.String:
+		if !v.IsString() {
+			return &UnmarshalTypeError{path, "string", jsTypeOf(v)}
+		}
+		rv.SetString(v.ToString())
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 && v.IsString() {
+			rv.SetBytes([]byte(v.ToString()))
+			return nil
+		}
+		if !v.IsArray() {
+			return &UnmarshalTypeError{path, "array", jsTypeOf(v)}
+		}
+		array := v.ToArray()
+		length := array.Length()
+		slice := reflect.MakeSlice(rv.Type(), length, length)
+		for i := 0; i < length; i++ {
+			if err := unmarshal(array.GetElement(i), slice.Index(i), indexPath(path, i), ancestors); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+	case reflect.Array:
+		if !v.IsArray() {
+			return &UnmarshalTypeError{path, "array", jsTypeOf(v)}
+		}
+		array := v.ToArray()
+		length := array.Length()
+		for i := 0; i < rv.Len(); i++ {
+			if i >= length {
+				rv.Index(i).Set(reflect.Zero(rv.Type().Elem()))
+				continue
+			}
+			if err := unmarshal(array.GetElement(i), rv.Index(i), indexPath(path, i), ancestors); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{rv.Type()}
+		}
+		if !v.IsObject() || v.IsArray() {
+			return &UnmarshalTypeError{path, "object", jsTypeOf(v)}
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		object := v.ToObject()
+		names := object.GetOwnPropertyNames()
+		length := names.Length()
+		for i := 0; i < length; i++ {
+			name := names.GetElement(i).ToString()
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := unmarshal(object.GetProperty(name), elem, propertyPath(path, name), ancestors); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()), elem)
+		}
+	case reflect.Struct:
+		if !v.IsObject() || v.IsArray() {
+			return &UnmarshalTypeError{path, "object", jsTypeOf(v)}
+		}
+		object := v.ToObject()
+		var names []string
+		for _, field := range structFields(rv.Type()) {
+			name := field.name
+			if !object.HasProperty(name) {
+				if names == nil {
+					names = ownPropertyNames(object)
+				}
+				if name = foldName(names, name); name == "" {
+					continue
+				}
+			}
+			prop := object.GetProperty(name)
+			if prop == nil || prop.IsUndefined() {
+				continue
+			}
+			fv, _ := fieldByIndex(rv, field.index, true)
+			if !fv.CanSet() {
+				continue
+			}
+			if err := unmarshal(prop, fv, propertyPath(path, name), ancestors); err != nil {
+				return err
+			}
+		}
+	default:
+		return &UnsupportedTypeError{rv.Type()}
+	}
+
+	return nil
+}
+
+func ownPropertyNames(object *Object) []string {
+	array := object.GetOwnPropertyNames()
+	names := make([]string, array.Length())
+	for i := range names {
+		names[i] = array.GetElement(i).ToString()
+	}
+	return names
+}
+
+// Finds the property that matches a field name case-insensitively,
+// "" when there is none.
+//
+func foldName(names []string, name string) string {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return n
+		}
+	}
+	return ""
+}
+
+// Converts a JavaScript value into the natural Go value for an
+// empty interface. Functions and regular expressions stay *Value.
+//
+func toInterface(v *Value, path string, ancestors []ancestor) (interface{}, error) {
+	if v.IsObject() && !v.IsDate() && !v.IsFunction() && !v.IsRegExp() {
+		var ok bool
+		if ancestors, ok = enterAncestor(ancestors, v); !ok {
+			return nil, &UnmarshalCycleError{path}
+		}
+	}
+
+	switch {
+	case v.IsNull() || v.IsUndefined():
+		return nil, nil
+	case v.IsBoolean():
+		return v.IsTrue(), nil
+	case v.IsNumber():
+		return v.ToNumber(), nil
+	case v.IsString():
+		return v.ToString(), nil
+	case v.IsDate():
+		t, ok := toTime(v)
+		if !ok {
+			return nil, &UnmarshalTypeError{path, "date", "invalid date"}
+		}
+		return t, nil
+	case v.IsFunction() || v.IsRegExp():
+		return v, nil
+	case v.IsArray():
+		array := v.ToArray()
+		length := array.Length()
+		result := make([]interface{}, length)
+		for i := 0; i < length; i++ {
+			elem, err := toInterface(array.GetElement(i), indexPath(path, i), ancestors)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = elem
+		}
+		return result, nil
+	case v.IsObject():
+		object := v.ToObject()
+		names := object.GetOwnPropertyNames()
+		length := names.Length()
+		result := make(map[string]interface{}, length)
+		for i := 0; i < length; i++ {
+			name := names.GetElement(i).ToString()
+			elem, err := toInterface(object.GetProperty(name), propertyPath(path, name), ancestors)
+			if err != nil {
+				return nil, err
+			}
+			result[name] = elem
+		}
+		return result, nil
+	}
+	return v, nil
+}
+
+// Converts a Date, false for an invalid one.
+//
+func toTime(v *Value) (time.Time, bool) {
+	ms := v.ToNumber()
+	if math.IsNaN(ms) {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(ms)), true
+}
+
+// Names the type of a JavaScript value for error messages.
+//
+func jsTypeOf(v *Value) string {
+	switch {
+	case v.IsUndefined():
+		return "undefined"
+	case v.IsNull():
+		return "null"
+	case v.IsBoolean():
+		return "boolean"
+	case v.IsNumber():
+		return "number"
+	case v.IsString():
+		return "string"
+	case v.IsArray():
+		return "array"
+	case v.IsFunction():
+		return "function"
+	case v.IsDate():
+		return "date"
+	case v.IsRegExp():
+		return "regexp"
+	}
+	return "object"
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func propertyPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func indexPath(path string, index int) string {
+	return path + "[" + strconv.Itoa(index) + "]"
+}
+
+type jsField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// Lists the fields of a struct type that are visible to JavaScript.
+// Fields of embedded structs and exported struct pointers without a
+// tag are promoted into the outer struct like encoding/json does.
+//
+func structFields(t reflect.Type) []jsField {
+	return embeddedFields(t, nil)
+}
+
+// Lists the fields of t, which is embedded in the outer types.
+//
+func embeddedFields(t reflect.Type, outer []reflect.Type) []jsField {
+	for _, o := range outer {
+		// a struct that embeds a pointer to itself
+		if o == t {
+			return nil
+		}
+	}
+	outer = append(outer, t)
+
+	fields := make([]jsField, 0, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		tag := sf.Tag.Get("js")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, opts = tag[:comma], tag[comma+1:]
+		}
+
+		if sf.Anonymous && name == "" {
+			embedded := sf.Type
+			if embedded.Kind() == reflect.Ptr && sf.PkgPath == "" {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for _, inner := range embeddedFields(embedded, outer) {
+					inner.index = append([]int{i}, inner.index...)
+					fields = append(fields, inner)
+				}
+				continue
+			}
+		}
+
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+
+		fields = append(fields, jsField{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+
+	return fields
+}
+
+// Like reflect.Value.FieldByIndex, but a nil embedded pointer on the
+// way is allocated when alloc is set and returns false otherwise.
+//
+func fieldByIndex(rv reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				if !alloc || !rv.CanSet() {
+					return reflect.Value{}, false
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,5 @@
+// +build !v8debug
+
+package v8
+
+const debugScopes = false
@@ -24,55 +24,107 @@ type Object struct {
 }
 
 func (cs *ContextScope) NewObject() *Value {
-	return newValue(C.V8_NewObject(cs.context.self))
+	return newValue(cs.context.engine, C.V8_NewObject(cs.ptr()))
 }
 
 func (o *Object) SetProperty(key string, value *Value, attribs PropertyAttribute) bool {
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&key)).Data)
 	return C.V8_Object_SetProperty(
-		o.self, (*C.char)(keyPtr), C.int(len(key)), value.self, C.int(attribs),
+		o.ptr(), (*C.char)(keyPtr), C.int(len(key)), value.ptrFor(o.engine), C.int(attribs),
 	) == 1
 }
 
 func (o *Object) GetProperty(key string) *Value {
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&key)).Data)
-	return newValue(C.V8_Object_GetProperty(
-		o.self, (*C.char)(keyPtr), C.int(len(key)),
+	return newValue(o.engine, C.V8_Object_GetProperty(
+		o.ptr(), (*C.char)(keyPtr), C.int(len(key)),
 	))
 }
 
 func (o *Object) SetElement(index int, value *Value) bool {
 	return C.V8_Object_SetElement(
-		o.self, C.uint32_t(index), value.self,
+		o.ptr(), C.uint32_t(index), value.ptrFor(o.engine),
 	) == 1
 }
 
 func (o *Object) GetElement(index int) *Value {
-	return newValue(C.V8_Object_GetElement(o.self, C.uint32_t(index)))
+	return newValue(o.engine, C.V8_Object_GetElement(o.ptr(), C.uint32_t(index)))
 }
 
 func (o *Object) GetPropertyAttributes(key string) PropertyAttribute {
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&key)).Data)
 	return PropertyAttribute(C.V8_Object_GetPropertyAttributes(
-		o.self, (*C.char)(keyPtr), C.int(len(key)),
+		o.ptr(), (*C.char)(keyPtr), C.int(len(key)),
 	))
 }
 
+// Not unique, two objects can share a hash.
+//
+func (o *Object) identityHash() int {
+	return int(C.V8_Object_GetIdentityHash(o.ptr()))
+}
+
 func (o *Object) InternalFieldCount() int {
-	return int(C.V8_Object_InternalFieldCount(o.self))
+	return int(C.V8_Object_InternalFieldCount(o.ptr()))
 }
 
-func (o *Object) GetInternalField(index int) interface{} {
-	data := C.V8_Object_GetInternalField(o.self, C.int(index))
-	return *(*interface{})(data)
+// Returns the Go value stored by SetInternalField. The result is false
+// when the index is out of range or the field holds no Go value.
+//
+func (o *Object) GetInternalField(index int) (interface{}, bool) {
+	if index < 0 || index >= o.InternalFieldCount() {
+		return nil, false
+	}
+
+	data := C.V8_Object_GetInternalField(o.ptr(), C.int(index))
+	if data == 0 {
+		return nil, false
+	}
+
+	return goHandle(data).lookup()
 }
 
+// Stores a Go value in the internal field. The value is kept alive
+// until the object is garbage collected by V8 or the field is set
+// again.
+//
 func (o *Object) SetInternalField(index int, value interface{}) {
-	C.V8_Object_SetInternalField(
-		o.self,
-		C.int(index),
-		unsafe.Pointer(&value),
-	)
+	o.checkInternalField(index)
+
+	h := newGoHandle(value)
+	old := C.V8_Object_SetInternalField(o.ptr(), C.int(index), h.c())
+
+	if old == 0 || !replaceWeakData(goHandle(old), h) {
+		o.setWeak(nil, h)
+	}
+}
+
+// Stores a raw pointer in the internal field, V8 doesn't look at it
+// and nothing keeps it alive. The pointer must be 2-byte aligned and
+// must not point to Go memory, which C isn't allowed to keep.
+//
+func (o *Object) SetAlignedPointerInInternalField(index int, pointer unsafe.Pointer) {
+	o.checkInternalField(index)
+
+	old := C.V8_Object_SetAlignedPointerInInternalField(o.ptr(), C.int(index), pointer)
+	if old != 0 {
+		replaceWeakData(goHandle(old), 0)
+	}
+}
+
+// Returns the pointer stored by SetAlignedPointerInInternalField. The
+// field must hold such a pointer.
+//
+func (o *Object) GetAlignedPointerFromInternalField(index int) unsafe.Pointer {
+	o.checkInternalField(index)
+
+	return C.V8_Object_GetAlignedPointerFromInternalField(o.ptr(), C.int(index))
+}
+
+func (o *Object) checkInternalField(index int) {
+	if index < 0 || index >= o.InternalFieldCount() {
+		panic("v8: internal field index out of range")
+	}
 }
 
 // Sets a local property on this object bypassing interceptors and
@@ -85,22 +137,22 @@ func (o *Object) SetInternalField(index int, value interface{}) {
 // Note also that this only works for named properties.
 func (o *Object) ForceSetProperty(key string, value *Value, attribs PropertyAttribute) bool {
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&key)).Data)
-	return C.V8_Object_ForceSetProperty(o.self,
-		(*C.char)(keyPtr), C.int(len(key)), value.self, C.int(attribs),
+	return C.V8_Object_ForceSetProperty(o.ptr(),
+		(*C.char)(keyPtr), C.int(len(key)), value.ptrFor(o.engine), C.int(attribs),
 	) == 1
 }
 
 func (o *Object) HasProperty(key string) bool {
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&key)).Data)
 	return C.V8_Object_HasProperty(
-		o.self, (*C.char)(keyPtr), C.int(len(key)),
+		o.ptr(), (*C.char)(keyPtr), C.int(len(key)),
 	) == 1
 }
 
 func (o *Object) DeleteProperty(key string) bool {
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&key)).Data)
 	return C.V8_Object_DeleteProperty(
-		o.self, (*C.char)(keyPtr), C.int(len(key)),
+		o.ptr(), (*C.char)(keyPtr), C.int(len(key)),
 	) == 1
 }
 
@@ -109,19 +161,19 @@ func (o *Object) DeleteProperty(key string) bool {
 func (o *Object) ForceDeleteProperty(key string) bool {
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&key)).Data)
 	return C.V8_Object_ForceDeleteProperty(
-		o.self, (*C.char)(keyPtr), C.int(len(key)),
+		o.ptr(), (*C.char)(keyPtr), C.int(len(key)),
 	) == 1
 }
 
 func (o *Object) HasElement(index int) bool {
 	return C.V8_Object_HasElement(
-		o.self, C.uint32_t(index),
+		o.ptr(), C.uint32_t(index),
 	) == 1
 }
 
 func (o *Object) DeleteElement(index int) bool {
 	return C.V8_Object_DeleteElement(
-		o.self, C.uint32_t(index),
+		o.ptr(), C.uint32_t(index),
 	) == 1
 }
 
@@ -131,7 +183,7 @@ func (o *Object) DeleteElement(index int) bool {
 // be enumerated by a for-in statement over this object.
 //
 func (o *Object) GetPropertyNames() *Array {
-	return newValue(C.V8_Object_GetPropertyNames(o.self)).ToArray()
+	return newValue(o.engine, C.V8_Object_GetPropertyNames(o.ptr())).ToArray()
 }
 
 // This function has the same functionality as GetPropertyNames but
@@ -139,7 +191,7 @@ func (o *Object) GetPropertyNames() *Array {
 // prototype objects.
 //
 func (o *Object) GetOwnPropertyNames() *Array {
-	return newValue(C.V8_Object_GetOwnPropertyNames(o.self)).ToArray()
+	return newValue(o.engine, C.V8_Object_GetOwnPropertyNames(o.ptr())).ToArray()
 }
 
 // Get the prototype object.  This does not skip objects marked to
@@ -147,7 +199,7 @@ func (o *Object) GetOwnPropertyNames() *Array {
 // handler.
 //
 func (o *Object) GetPrototype() *Object {
-	return newValue(C.V8_Object_GetPrototype(o.self)).ToObject()
+	return newValue(o.engine, C.V8_Object_GetPrototype(o.ptr())).ToObject()
 }
 
 // Set the prototype object.  This does not skip objects marked to
@@ -155,7 +207,7 @@ func (o *Object) GetPrototype() *Object {
 // handler.
 //
 func (o *Object) SetPrototype(proto *Object) bool {
-	return C.V8_Object_SetPrototype(o.self, proto.self) == 1
+	return C.V8_Object_SetPrototype(o.ptr(), proto.ptrFor(o.engine)) == 1
 }
 
 // An instance of the built-in array constructor (ECMA-262, 15.4.2).
@@ -165,13 +217,13 @@ type Array struct {
 }
 
 func (cs ContextScope) NewArray(length int) *Array {
-	return newValue(C.V8_NewArray(
-		cs.context.self, C.int(length),
+	return newValue(cs.context.engine, C.V8_NewArray(
+		cs.ptr(), C.int(length),
 	)).ToArray()
 }
 
 func (a *Array) Length() int {
-	return int(C.V8_Array_Length(a.self))
+	return int(C.V8_Array_Length(a.ptr()))
 }
 
 type RegExpFlags int
@@ -206,8 +258,8 @@ type RegExp struct {
 func (cs ContextScope) NewRegExp(pattern string, flags RegExpFlags) *Value {
 	patternPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&pattern)).Data)
 
-	return newValue(C.V8_NewRegExp(
-		cs.context.self, (*C.char)(patternPtr), C.int(len(pattern)), C.int(flags),
+	return newValue(cs.context.engine, C.V8_NewRegExp(
+		cs.ptr(), (*C.char)(patternPtr), C.int(len(pattern)), C.int(flags),
 	))
 }
 
@@ -215,7 +267,7 @@ func (cs ContextScope) NewRegExp(pattern string, flags RegExpFlags) *Value {
 // the regular expression.
 func (r *RegExp) Pattern() string {
 	if !r.patternCached {
-		cstring := C.V8_RegExp_Pattern(r.self)
+		cstring := C.V8_RegExp_Pattern(r.ptr())
 		r.pattern = C.GoString(cstring)
 		r.patternCached = true
 		C.free(unsafe.Pointer(cstring))
@@ -227,7 +279,7 @@ func (r *RegExp) Pattern() string {
 //
 func (r *RegExp) Flags() RegExpFlags {
 	if !r.flagsCached {
-		r.flags = RegExpFlags(C.V8_RegExp_Flags(r.self))
+		r.flags = RegExpFlags(C.V8_RegExp_Flags(r.ptr()))
 		r.flagsCached = true
 	}
 	return r.flags
@@ -0,0 +1,301 @@
+package v8
+
+import "context"
+import "errors"
+import "fmt"
+import "sync"
+import "time"
+
+// Returned by Pool.Acquire once the pool is closed.
+//
+var ErrPoolClosed = errors.New("v8: pool is closed")
+
+type PoolOptions struct {
+	// Number of engines, at least one.
+	Size int
+
+	// Resource limits of each engine.
+	Engine EngineOptions
+
+	// Prepares a new engine: installs its templates, creates the
+	// context handed out with it and runs the bootstrap scripts.
+	// The engine is disposed when it returns an error or panics.
+	Setup func(e *Engine) (*Context, error)
+
+	// Called when an engine is released, returning false disposes
+	// and replaces it. Dead engines are always replaced.
+	HealthCheck func(pe *PooledEngine) bool
+
+	// Engines are replaced after this many uses, zero means never.
+	MaxUses int
+}
+
+// An engine checked out of a pool, it must be given back with
+// Pool.Release and not be used afterwards.
+//
+type PooledEngine struct {
+	Engine   *Engine
+	Context  *Context
+	uses     int
+	released bool
+}
+
+type PoolStats struct {
+	Size     int
+	Idle     int
+	InUse    int
+	Acquires int64
+	Recycled int64
+
+	// Setup errors of replacement engines.
+	SetupErrors int64
+
+	// Time Acquire spent waiting for an idle engine.
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+// A fixed number of pre-warmed engines, each serving one borrower at a
+// time, so goroutines don't serialize on a single engine.
+//
+type Pool struct {
+	options PoolOptions
+	idle    chan *PooledEngine
+	wake    chan struct{}
+
+	mutex   sync.Mutex
+	closed  bool
+	missing int
+	inUse   int
+	stats   PoolStats
+}
+
+// Creates the pool and sets up all of its engines.
+//
+func NewPool(options PoolOptions) (*Pool, error) {
+	if options.Size < 1 {
+		return nil, errors.New("v8: pool size must be at least one")
+	}
+
+	if options.Setup == nil {
+		return nil, errors.New("v8: pool needs a setup function")
+	}
+
+	p := &Pool{
+		options: options,
+		idle:    make(chan *PooledEngine, options.Size),
+		wake:    make(chan struct{}, 1),
+	}
+	p.stats.Size = options.Size
+
+	for i := 0; i < options.Size; i++ {
+		pe, err := p.newEngine()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle <- pe
+	}
+
+	return p, nil
+}
+
+func (p *Pool) newEngine() (pe *PooledEngine, err error) {
+	e := NewEngineWithOptions(p.options.Engine)
+
+	// replacements are set up on their own goroutine, a panic there
+	// would crash the process, so it fails the setup instead
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("v8: pool setup panicked: %v", r)
+		}
+		if err != nil {
+			pe = nil
+			e.Dispose()
+		}
+	}()
+
+	c, err := p.options.Setup(e)
+	if err == nil && c == nil {
+		err = errors.New("v8: pool setup returned no context")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &PooledEngine{Engine: e, Context: c}, nil
+}
+
+// Checks out an engine, waiting until one is idle or ctx is done.
+//
+func (p *Pool) Acquire(ctx context.Context) (*PooledEngine, error) {
+	start := time.Now()
+
+	for {
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		// an engine whose replacement failed is set up again here,
+		// so its error reaches a caller
+		replace := p.missing > 0 && len(p.idle) == 0
+		if replace {
+			p.missing -= 1
+		}
+		p.mutex.Unlock()
+
+		var pe *PooledEngine
+
+		if replace {
+			var err error
+			if pe, err = p.newEngine(); err != nil {
+				p.mutex.Lock()
+				p.missing += 1
+				p.stats.SetupErrors += 1
+				p.signalWake()
+				p.mutex.Unlock()
+				return nil, err
+			}
+		} else {
+			select {
+			case pe = <-p.idle:
+			case <-p.wake:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		wait := time.Since(start)
+
+		p.mutex.Lock()
+		pe.released = false
+		p.inUse += 1
+		p.stats.Acquires += 1
+		p.stats.TotalWait += wait
+		if wait > p.stats.MaxWait {
+			p.stats.MaxWait = wait
+		}
+		p.mutex.Unlock()
+
+		return pe, nil
+	}
+}
+
+// Gives back an engine checked out by Acquire. Dead, unhealthy and
+// worn out engines are replaced in the background. Releasing an engine
+// twice panics.
+//
+func (p *Pool) Release(pe *PooledEngine) {
+	p.mutex.Lock()
+	if pe.released {
+		p.mutex.Unlock()
+		panic("v8: pooled engine released twice")
+	}
+	pe.released = true
+	pe.uses += 1
+	p.inUse -= 1
+	p.mutex.Unlock()
+
+	healthy := !pe.Engine.IsDead()
+	if healthy && p.options.HealthCheck != nil {
+		healthy = p.options.HealthCheck(pe)
+	}
+
+	if healthy && (p.options.MaxUses == 0 || pe.uses < p.options.MaxUses) {
+		p.mutex.Lock()
+		closed := p.closed
+		if !closed {
+			p.idle <- pe
+		}
+		p.mutex.Unlock()
+
+		if closed {
+			pe.Engine.Dispose()
+		}
+		return
+	}
+
+	pe.Engine.Dispose()
+
+	p.mutex.Lock()
+	p.stats.Recycled += 1
+	closed := p.closed
+	p.mutex.Unlock()
+
+	if !closed {
+		go p.replace()
+	}
+}
+
+func (p *Pool) replace() {
+	pe, err := p.newEngine()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch {
+	case p.closed:
+		if pe != nil {
+			pe.Engine.Dispose()
+		}
+	case err != nil:
+		p.missing += 1
+		p.stats.SetupErrors += 1
+		p.signalWake()
+	default:
+		p.idle <- pe
+	}
+}
+
+// Wakes a waiting Acquire to retry the setup of a missing engine, so
+// another caller gets the next error or the engine. Must be called with
+// p.mutex locked.
+//
+func (p *Pool) signalWake() {
+	// Close woke everyone already
+	if p.closed {
+		return
+	}
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := p.stats
+	stats.Idle = len(p.idle)
+	stats.InUse = p.inUse
+	return stats
+}
+
+// Disposes the idle engines, the checked out ones are disposed when
+// they are released. Acquire returns ErrPoolClosed afterwards.
+//
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+
+	for {
+		select {
+		case pe := <-p.idle:
+			pe.Engine.Dispose()
+		default:
+			// wake the waiting Acquire calls
+			close(p.wake)
+			return
+		}
+	}
+}
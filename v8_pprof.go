@@ -0,0 +1,199 @@
+package v8
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Field numbers of profile.proto, the format read by go tool pprof.
+const (
+	pprofProfileSampleType    = 1
+	pprofProfileSample        = 2
+	pprofProfileLocation      = 4
+	pprofProfileFunction      = 5
+	pprofProfileStringTable   = 6
+	pprofProfileTimeNanos     = 9
+	pprofProfileDurationNanos = 10
+	pprofProfilePeriodType    = 11
+	pprofProfilePeriod        = 12
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationId = 1
+	pprofSampleValue      = 2
+
+	pprofLocationId   = 1
+	pprofLocationLine = 4
+
+	pprofLineFunctionId = 1
+	pprofLineLine       = 2
+
+	pprofFunctionId         = 1
+	pprofFunctionName       = 2
+	pprofFunctionSystemName = 3
+	pprofFunctionFilename   = 4
+	pprofFunctionStartLine  = 5
+)
+
+// V8 samples about every millisecond, used when the profile is too
+// short to estimate the interval.
+const defaultSamplingPeriod = 1000000
+
+// Minimal protocol buffer encoder, just enough for profile.proto.
+type protobuf struct {
+	data []byte
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protobuf) key(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protobuf) int64(field int, x int64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(uint64(x))
+}
+
+func (b *protobuf) packed(field int, xs []int64) {
+	var values protobuf
+	for _, x := range xs {
+		values.varint(uint64(x))
+	}
+	b.bytes(field, values.data)
+}
+
+func (b *protobuf) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protobuf) message(field int, m *protobuf) {
+	b.bytes(field, m.data)
+}
+
+type pprofFunction struct {
+	name   string
+	script string
+	line   int
+}
+
+type pprofWriter struct {
+	profile   protobuf
+	strings   map[string]int64
+	functions map[pprofFunction]int64
+}
+
+func (w *pprofWriter) str(s string) int64 {
+	if index, ok := w.strings[s]; ok {
+		return index
+	}
+	index := int64(len(w.strings))
+	w.strings[s] = index
+	w.profile.bytes(pprofProfileStringTable, []byte(s))
+	return index
+}
+
+func (w *pprofWriter) valueType(field int, typ, unit string) {
+	var m protobuf
+	m.int64(pprofValueTypeType, w.str(typ))
+	m.int64(pprofValueTypeUnit, w.str(unit))
+	w.profile.message(field, &m)
+}
+
+// Every function gets one location with the same id, V8 only reports
+// the line where the function starts.
+func (w *pprofWriter) location(node *CPUProfileNode) int64 {
+	name := node.FunctionName
+	if name == "" {
+		name = "(anonymous)"
+	}
+
+	key := pprofFunction{name, node.ScriptName, node.LineNumber}
+	if id, ok := w.functions[key]; ok {
+		return id
+	}
+
+	id := int64(len(w.functions) + 1)
+	w.functions[key] = id
+
+	var function protobuf
+	function.int64(pprofFunctionId, id)
+	function.int64(pprofFunctionName, w.str(name))
+	function.int64(pprofFunctionSystemName, w.str(name))
+	function.int64(pprofFunctionFilename, w.str(node.ScriptName))
+	function.int64(pprofFunctionStartLine, int64(node.LineNumber))
+	w.profile.message(pprofProfileFunction, &function)
+
+	var line protobuf
+	line.int64(pprofLineFunctionId, id)
+	line.int64(pprofLineLine, int64(node.LineNumber))
+
+	var location protobuf
+	location.int64(pprofLocationId, id)
+	location.message(pprofLocationLine, &line)
+	w.profile.message(pprofProfileLocation, &location)
+
+	return id
+}
+
+// Writes the profile as a gzipped pprof protobuf, the format read by
+// go tool pprof. Each node with hits becomes one sample whose stack
+// goes from the node up to the root, which itself is left out.
+//
+func (p *CPUProfile) WritePprof(w io.Writer) error {
+	pw := &pprofWriter{
+		strings:   make(map[string]int64),
+		functions: make(map[pprofFunction]int64),
+	}
+
+	// string_table[0] must be the empty string
+	pw.str("")
+
+	pw.valueType(pprofProfileSampleType, "samples", "count")
+	pw.valueType(pprofProfileSampleType, "cpu", "nanoseconds")
+
+	duration := (p.EndTime - p.StartTime) * 1000
+	period := int64(defaultSamplingPeriod)
+	if p.Root != nil && p.Root.TotalHitCount > 0 && duration > 0 {
+		period = duration / int64(p.Root.TotalHitCount)
+	}
+
+	for _, node := range p.nodes {
+		if node.HitCount == 0 || node == p.Root {
+			continue
+		}
+
+		var stack []int64
+		for n := node; n != nil && n != p.Root; n = n.Parent {
+			stack = append(stack, pw.location(n))
+		}
+
+		var sample protobuf
+		sample.packed(pprofSampleLocationId, stack)
+		sample.packed(pprofSampleValue, []int64{int64(node.HitCount), int64(node.HitCount) * period})
+		pw.profile.message(pprofProfileSample, &sample)
+	}
+
+	pw.profile.int64(pprofProfileTimeNanos, p.stopped.UnixNano()-duration)
+	pw.profile.int64(pprofProfileDurationNanos, duration)
+	pw.valueType(pprofProfilePeriodType, "cpu", "nanoseconds")
+	pw.profile.int64(pprofProfilePeriod, period)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(pw.profile.data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
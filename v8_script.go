@@ -5,6 +5,7 @@ package v8
 #include <stdlib.h>
 */
 import "C"
+import "context"
 import "unsafe"
 import "reflect"
 import "runtime"
@@ -12,7 +13,8 @@ import "runtime"
 // A compiled JavaScript script.
 //
 type Script struct {
-	self unsafe.Pointer
+	self   unsafe.Pointer
+	engine *Engine
 }
 
 // Pre-compiles the specified script (context-independent).
@@ -20,7 +22,7 @@ type Script struct {
 func (e *Engine) PreCompile(code []byte) *ScriptData {
 	codePtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&code)).Data)
 	return newScriptData(C.V8_PreCompile(
-		e.self, (*C.char)(codePtr), C.int(len(code)),
+		e.ptr(), (*C.char)(codePtr), C.int(len(code)),
 	))
 }
 
@@ -29,10 +31,46 @@ func (e *Engine) PreCompile(code []byte) *ScriptData {
 // using pre_data speeds compilation if it's done multiple times.
 //
 func (e *Engine) Compile(code []byte, origin *ScriptOrigin, data *ScriptData) *Script {
+	return e.compile(code, origin, data, nil)
+}
+
+// Like Compile but returns the syntax error as a *JSError instead of
+// reporting it to the message listeners.
+//
+func (e *Engine) CompileE(code []byte, origin *ScriptOrigin, data *ScriptData) (*Script, error) {
+	if e.IsDead() {
+		return nil, ErrEngineDead
+	}
+
+	var exception *C.V8_Exception
+
+	script := e.compile(code, origin, data, &exception)
+
+	if exception != nil {
+		return nil, exceptionError(e, exception)
+	}
+
+	if script == nil && e.IsDead() {
+		return nil, ErrEngineDead
+	}
+
+	return script, nil
+}
+
+// Compiles a context-independent script (v8::Script::New) that can be
+// run in many contexts with RunIn. Compile makes the same kind of
+// script in this V8 version, this name states the intent.
+//
+func (e *Engine) CompileUnbound(code []byte, origin *ScriptOrigin, data *ScriptData) *Script {
+	return e.compile(code, origin, data, nil)
+}
+
+func (e *Engine) compile(code []byte, origin *ScriptOrigin, data *ScriptData, exception **C.V8_Exception) *Script {
 	var originPtr unsafe.Pointer
 	var dataPtr unsafe.Pointer
 
 	if origin != nil {
+		e.checkOwner(origin.engine, "script origin")
 		originPtr = origin.self
 	}
 
@@ -41,30 +79,71 @@ func (e *Engine) Compile(code []byte, origin *ScriptOrigin, data *ScriptData) *S
 	}
 
 	codePtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&code)).Data)
-	self := C.V8_Compile(e.self, (*C.char)(codePtr), C.int(len(code)), originPtr, dataPtr)
+	self := C.V8_Compile(e.ptr(), (*C.char)(codePtr), C.int(len(code)), originPtr, dataPtr, exception)
 
 	if self == nil {
 		return nil
 	}
 
 	result := &Script{
-		self: self,
+		self:   self,
+		engine: e,
 	}
 
+	e.track(&e.scripts, self)
+
 	runtime.SetFinalizer(result, func(s *Script) {
-		if traceDispose {
-			println("v8.Script.Dispose()", s.self)
-		}
-		C.V8_DisposeScript(s.self)
+		s.engine.untrack(&s.engine.scripts, &s.engine.queuedScripts, s.self)
 	})
 
 	return result
 }
 
+func (s *Script) ptr() unsafe.Pointer {
+	s.engine.ptr()
+	return s.self
+}
+
 // Runs the script returning the resulting value.
 //
 func (s *Script) Run() *Value {
-	return newValue(C.V8_Script_Run(s.self))
+	result := newValue(s.engine, C.V8_Script_Run(s.ptr(), nil))
+	s.engine.checkAPIError()
+	return result
+}
+
+// Like Run but returns the thrown exception as a *JSError.
+//
+func (s *Script) RunE() (*Value, error) {
+	return s.RunContext(context.Background())
+}
+
+// Runs the script in the context of cs, whatever context is entered
+// by nested scopes.
+//
+func (s *Script) RunIn(cs ContextScope) *Value {
+	result := s.runIn(cs, nil)
+	s.engine.checkAPIError()
+	return result
+}
+
+// Like RunIn but returns the thrown exception as a *JSError.
+//
+func (s *Script) RunInE(cs ContextScope) (*Value, error) {
+	return runContext(context.Background(), s.engine, func(exception **C.V8_Exception) *Value {
+		return s.runIn(cs, exception)
+	})
+}
+
+func (s *Script) runIn(cs ContextScope, exception **C.V8_Exception) *Value {
+	s.engine.checkOwner(cs.context.engine, "context scope")
+	self, context := s.ptr(), cs.ptr()
+
+	// callbacks of the script run in the given context
+	contextHandle := newGoHandle(cs.context)
+	defer contextHandle.delete()
+
+	return newValue(s.engine, C.V8_Script_RunIn(self, context, contextHandle.c(), exception))
 }
 
 // Pre-compilation data that can be associated with a script.  This
@@ -86,9 +165,6 @@ func newScriptData(self unsafe.Pointer) *ScriptData {
 	}
 
 	runtime.SetFinalizer(result, func(s *ScriptData) {
-		if traceDispose {
-			println("v8.ScriptData.Dispose()")
-		}
 		C.V8_DisposeScriptData(s.self)
 	})
 
@@ -130,6 +206,7 @@ func (sd *ScriptData) HasError() bool {
 //
 type ScriptOrigin struct {
 	self         unsafe.Pointer
+	engine       *Engine
 	Name         string
 	LineOffset   int
 	ColumnOffset int
@@ -137,7 +214,7 @@ type ScriptOrigin struct {
 
 func (e *Engine) NewScriptOrigin(name string, lineOffset, columnOffset int) *ScriptOrigin {
 	namePtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&name)).Data)
-	self := C.V8_NewScriptOrigin(e.self, (*C.char)(namePtr), C.int(len(name)), C.int(lineOffset), C.int(columnOffset))
+	self := C.V8_NewScriptOrigin(e.ptr(), (*C.char)(namePtr), C.int(len(name)), C.int(lineOffset), C.int(columnOffset))
 
 	if self == nil {
 		return nil
@@ -145,15 +222,13 @@ func (e *Engine) NewScriptOrigin(name string, lineOffset, columnOffset int) *Scr
 
 	result := &ScriptOrigin{
 		self:         self,
+		engine:       e,
 		Name:         name,
 		LineOffset:   lineOffset,
 		ColumnOffset: columnOffset,
 	}
 
 	runtime.SetFinalizer(result, func(so *ScriptOrigin) {
-		if traceDispose {
-			println("v8.ScriptOrigin.Dispose()")
-		}
 		C.V8_DisposeScriptOrigin(so.self)
 	})
 
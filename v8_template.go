@@ -4,9 +4,11 @@ package v8
 #include "v8_wrap.h"
 */
 import "C"
+import "context"
 import "unsafe"
 import "reflect"
 import "sync"
+import "sync/atomic"
 
 type AccessControl int
 
@@ -39,6 +41,10 @@ type ObjectTemplate struct {
 	properties         map[string]*propertyInfo
 	self               unsafe.Pointer
 	internalFieldCount int
+
+	// the callbacks registered by the template, C may call the ones
+	// that were replaced until the template is disposed
+	handles []goHandle
 }
 
 type namedPropertyInfo struct {
@@ -65,6 +71,7 @@ type accessorInfo struct {
 	setter  AccessorSetterCallback
 	data    interface{}
 	attribs PropertyAttribute
+	handle  goHandle
 }
 
 type NamedPropertyGetterCallback func(string, PropertyCallbackInfo)
@@ -105,17 +112,23 @@ func newObjectTemplate(e *Engine, self unsafe.Pointer) *ObjectTemplate {
 }
 
 func (e *Engine) NewObjectTemplate() *ObjectTemplate {
-	self := C.V8_NewObjectTemplate(e.self)
+	self := C.V8_NewObjectTemplate(e.ptr())
 
 	return newObjectTemplate(e, self)
 }
 
+// Frees the template and releases its callbacks, objects created or
+// wrapped by it throw when their accessors and handlers are used
+// afterwards.
+//
 func (ot *ObjectTemplate) Dispose() {
 	ot.Lock()
 	defer ot.Unlock()
 
 	if ot.id > 0 {
 		delete(ot.engine.objectTemplates, ot.id)
+		ot.engine.deleteCallbackHandles(ot.handles)
+		ot.handles = nil
 		ot.id = 0
 		ot.engine = nil
 		C.V8_DisposeObjectTemplate(ot.self)
@@ -130,13 +143,18 @@ func (ot *ObjectTemplate) NewObject() *Value {
 		return nil
 	}
 
-	return newValue(C.V8_ObjectTemplate_NewObject(ot.self))
+	result := newValue(ot.engine, C.V8_ObjectTemplate_NewObject(ot.self))
+	ot.engine.checkAPIError()
+	return result
 }
 
 func (ot *ObjectTemplate) WrapObject(value *Value) {
 	ot.Lock()
 	defer ot.Unlock()
 
+	ot.ptr()
+	ot.engine.checkOwner(value.engine, "value")
+
 	object := value.ToObject()
 
 	for _, info := range ot.accessors {
@@ -149,6 +167,11 @@ func (ot *ObjectTemplate) WrapObject(value *Value) {
 }
 
 func (ot *ObjectTemplate) SetProperty(key string, value *Value, attribs PropertyAttribute) {
+	ot.Lock()
+	defer ot.Unlock()
+
+	self := ot.ptr()
+
 	info := &propertyInfo{
 		key:     key,
 		value:   value,
@@ -160,19 +183,40 @@ func (ot *ObjectTemplate) SetProperty(key string, value *Value, attribs Property
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&info.key)).Data)
 
 	C.V8_ObjectTemplate_SetProperty(
-		ot.self, (*C.char)(keyPtr), C.int(len(key)), value.self, C.int(attribs),
+		self, (*C.char)(keyPtr), C.int(len(key)), value.ptrFor(ot.engine), C.int(attribs),
 	)
 }
 
 func (ot *ObjectTemplate) SetInternalFieldCount(count int) {
-	C.V8_ObjectTemplate_SetInternalFieldCount(ot.self, C.int(count))
+	ot.Lock()
+	defer ot.Unlock()
+
+	self := ot.ptr()
+
+	C.V8_ObjectTemplate_SetInternalFieldCount(self, C.int(count))
 	ot.internalFieldCount = count
 }
 
+// Returns the native template, panicking once it was disposed. Must be
+// called with the template locked.
+//
+func (ot *ObjectTemplate) ptr() unsafe.Pointer {
+	if ot.engine == nil {
+		panic("v8: object template is disposed")
+	}
+	return ot.self
+}
+
 func (ot *ObjectTemplate) InternalFieldCount() int {
 	return ot.internalFieldCount
 }
 
+func (ot *ObjectTemplate) newCallbackHandle(value interface{}) goHandle {
+	h := ot.engine.newCallbackHandle(value)
+	ot.handles = append(ot.handles, h)
+	return h
+}
+
 func (ot *ObjectTemplate) SetAccessor(
 	key string,
 	getter AccessorGetterCallback,
@@ -180,6 +224,11 @@ func (ot *ObjectTemplate) SetAccessor(
 	data interface{},
 	attribs PropertyAttribute,
 ) {
+	ot.Lock()
+	defer ot.Unlock()
+
+	self := ot.ptr()
+
 	info := &accessorInfo{
 		key:     key,
 		getter:  getter,
@@ -188,25 +237,17 @@ func (ot *ObjectTemplate) SetAccessor(
 		attribs: attribs,
 	}
 
+	info.handle = ot.newCallbackHandle(info)
 	ot.accessors[key] = info
 
-	var getterPointer, setterPointer unsafe.Pointer
-	if info.getter != nil {
-		getterPointer = unsafe.Pointer(&info.getter)
-	}
-
-	if info.setter != nil {
-		setterPointer = unsafe.Pointer(&info.setter)
-	}
-
+	h := info.handle
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&info.key)).Data)
 
 	C.V8_ObjectTemplate_SetAccessor(
-		ot.self,
+		self,
 		(*C.char)(keyPtr), C.int(len(info.key)),
-		getterPointer,
-		setterPointer,
-		unsafe.Pointer(&(info.data)),
+		h.cIf(info.getter != nil),
+		h.cIf(info.setter != nil),
 		C.int(info.attribs),
 	)
 }
@@ -219,6 +260,11 @@ func (ot *ObjectTemplate) SetNamedPropertyHandler(
 	enumerator NamedPropertyEnumeratorCallback,
 	data interface{},
 ) {
+	ot.Lock()
+	defer ot.Unlock()
+
+	self := ot.ptr()
+
 	info := &namedPropertyInfo{
 		getter:     getter,
 		setter:     setter,
@@ -229,35 +275,16 @@ func (ot *ObjectTemplate) SetNamedPropertyHandler(
 	}
 
 	ot.namedInfo = info
-	var getterPointer, setterPointer, queryPointer, deleterPointer, enumeratorPointer unsafe.Pointer
-	if info.getter != nil {
-		getterPointer = unsafe.Pointer(&info.getter)
-	}
-
-	if info.setter != nil {
-		setterPointer = unsafe.Pointer(&info.setter)
-	}
-
-	if info.query != nil {
-		queryPointer = unsafe.Pointer(&info.query)
-	}
-
-	if info.deleter != nil {
-		deleterPointer = unsafe.Pointer(&info.deleter)
-	}
-
-	if info.enumerator != nil {
-		enumeratorPointer = unsafe.Pointer(&info.enumerator)
-	}
+	h := ot.newCallbackHandle(info)
 
 	C.V8_ObjectTemplate_SetNamedPropertyHandler(
-		ot.self,
-		getterPointer,
-		setterPointer,
-		queryPointer,
-		deleterPointer,
-		enumeratorPointer,
-		unsafe.Pointer(&data))
+		self,
+		h.cIf(info.getter != nil),
+		h.cIf(info.setter != nil),
+		h.cIf(info.query != nil),
+		h.cIf(info.deleter != nil),
+		h.cIf(info.enumerator != nil),
+	)
 }
 
 func (ot *ObjectTemplate) SetIndexedPropertyHandler(
@@ -268,6 +295,11 @@ func (ot *ObjectTemplate) SetIndexedPropertyHandler(
 	enumerator IndexedPropertyEnumeratorCallback,
 	data interface{},
 ) {
+	ot.Lock()
+	defer ot.Unlock()
+
+	self := ot.ptr()
+
 	info := &indexedPropertyInfo{
 		getter:     getter,
 		setter:     setter,
@@ -277,37 +309,17 @@ func (ot *ObjectTemplate) SetIndexedPropertyHandler(
 		data:       data,
 	}
 
-	var getterPointer, setterPointer, queryPointer, deleterPointer, enumeratorPointer unsafe.Pointer
-	if info.getter != nil {
-		getterPointer = unsafe.Pointer(&info.getter)
-	}
-
-	if info.setter != nil {
-		setterPointer = unsafe.Pointer(&info.setter)
-	}
-
-	if info.query != nil {
-		queryPointer = unsafe.Pointer(&info.query)
-	}
-
-	if info.deleter != nil {
-		deleterPointer = unsafe.Pointer(&info.deleter)
-	}
-
-	if info.enumerator != nil {
-		enumeratorPointer = unsafe.Pointer(&info.enumerator)
-	}
-
 	ot.indexedInfo = info
+	h := ot.newCallbackHandle(info)
 
 	C.V8_ObjectTemplate_SetIndexedPropertyHandler(
-		ot.self,
-		getterPointer,
-		setterPointer,
-		queryPointer,
-		deleterPointer,
-		enumeratorPointer,
-		unsafe.Pointer(&data))
+		self,
+		h.cIf(info.getter != nil),
+		h.cIf(info.setter != nil),
+		h.cIf(info.query != nil),
+		h.cIf(info.deleter != nil),
+		h.cIf(info.enumerator != nil),
+	)
 }
 
 type PropertyCallbackInfo struct {
@@ -319,15 +331,15 @@ type PropertyCallbackInfo struct {
 }
 
 func (p PropertyCallbackInfo) CurrentScope() ContextScope {
-	return ContextScope{p.context}
+	return newContextScope(p.context, nil)
 }
 
 func (p PropertyCallbackInfo) This() *Object {
-	return newValue(C.V8_PropertyCallbackInfo_This(p.self, p.typ)).ToObject()
+	return newValue(p.context.engine, C.V8_PropertyCallbackInfo_This(p.self, p.typ)).ToObject()
 }
 
 func (p PropertyCallbackInfo) Holder() *Object {
-	return newValue(C.V8_PropertyCallbackInfo_Holder(p.self, p.typ)).ToObject()
+	return newValue(p.context.engine, C.V8_PropertyCallbackInfo_Holder(p.self, p.typ)).ToObject()
 }
 
 func (p PropertyCallbackInfo) Data() interface{} {
@@ -337,6 +349,7 @@ func (p PropertyCallbackInfo) Data() interface{} {
 func (p PropertyCallbackInfo) ReturnValue() ReturnValue {
 	if p.returnValue.self == nil {
 		p.returnValue.self = C.V8_PropertyCallbackInfo_ReturnValue(p.self, p.typ)
+		p.returnValue.engine = p.context.engine
 	}
 	return p.returnValue
 }
@@ -352,15 +365,15 @@ type AccessorCallbackInfo struct {
 }
 
 func (ac AccessorCallbackInfo) CurrentScope() ContextScope {
-	return ContextScope{ac.context}
+	return newContextScope(ac.context, nil)
 }
 
 func (ac AccessorCallbackInfo) This() *Object {
-	return newValue(C.V8_AccessorCallbackInfo_This(ac.self, ac.typ)).ToObject()
+	return newValue(ac.context.engine, C.V8_AccessorCallbackInfo_This(ac.self, ac.typ)).ToObject()
 }
 
 func (ac AccessorCallbackInfo) Holder() *Object {
-	return newValue(C.V8_AccessorCallbackInfo_Holder(ac.self, ac.typ)).ToObject()
+	return newValue(ac.context.engine, C.V8_AccessorCallbackInfo_Holder(ac.self, ac.typ)).ToObject()
 }
 
 func (ac AccessorCallbackInfo) Data() interface{} {
@@ -370,6 +383,7 @@ func (ac AccessorCallbackInfo) Data() interface{} {
 func (ac *AccessorCallbackInfo) ReturnValue() ReturnValue {
 	if ac.returnValue.self == nil {
 		ac.returnValue.self = C.V8_AccessorCallbackInfo_ReturnValue(ac.self, ac.typ)
+		ac.returnValue.engine = ac.context.engine
 	}
 	return ac.returnValue
 }
@@ -379,93 +393,95 @@ type AccessorGetterCallback func(name string, info AccessorCallbackInfo)
 type AccessorSetterCallback func(name string, value *Value, info AccessorCallbackInfo)
 
 //export go_accessor_callback
-func go_accessor_callback(typ C.AccessorDataEnum, info *C.V8_AccessorCallbackInfo, context unsafe.Pointer) {
-	name := reflect.StringHeader{
-		Data: uintptr(unsafe.Pointer(info.key)),
-		Len:  int(info.key_length),
-	}
-	gname := *((*string)(unsafe.Pointer(&name)))
+func go_accessor_callback(typ C.AccessorDataEnum, info *C.V8_AccessorCallbackInfo, context C.V8_GoHandle) {
+	c := callbackContext(context)
+	defer c.recoverCallbackPanic()
+
+	accessor := goHandle(info.callback).value().(*accessorInfo)
 	switch typ {
 	case C.OTA_Getter:
-		(*(*AccessorGetterCallback)(info.callback))(
-			gname,
-			AccessorCallbackInfo{unsafe.Pointer(info), *(*interface{})(info.data), ReturnValue{}, (*Context)(context), typ})
+		accessor.getter(
+			accessor.key,
+			AccessorCallbackInfo{unsafe.Pointer(info), accessor.data, ReturnValue{}, c, typ})
 	case C.OTA_Setter:
-		(*(*AccessorSetterCallback)(info.callback))(
-			gname,
-			newValue(info.setValue),
-			AccessorCallbackInfo{unsafe.Pointer(info), *(*interface{})(info.data), ReturnValue{}, (*Context)(context), typ})
+		accessor.setter(
+			accessor.key,
+			newValue(c.engine, info.setValue),
+			AccessorCallbackInfo{unsafe.Pointer(info), accessor.data, ReturnValue{}, c, typ})
 	default:
 		panic("impossible type")
 	}
 }
 
 //export go_named_property_callback
-func go_named_property_callback(typ C.PropertyDataEnum, info *C.V8_PropertyCallbackInfo, context unsafe.Pointer) {
+func go_named_property_callback(typ C.PropertyDataEnum, info *C.V8_PropertyCallbackInfo, context C.V8_GoHandle) {
+	c := callbackContext(context)
+	defer c.recoverCallbackPanic()
+
 	gname := ""
 	if info.key != nil {
 		gname = C.GoString(info.key)
 	}
+	handler := goHandle(info.callback).value().(*namedPropertyInfo)
 	switch typ {
 	case C.OTP_Getter:
-		(*(*NamedPropertyGetterCallback)(info.callback))(
-			gname, PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+		handler.getter(
+			gname, PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	case C.OTP_Setter:
-		(*(*NamedPropertySetterCallback)(info.callback))(
+		handler.setter(
 			gname,
-			newValue(info.setValue),
-			PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+			newValue(c.engine, info.setValue),
+			PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	case C.OTP_Deleter:
-		(*(*NamedPropertyDeleterCallback)(info.callback))(
-			gname, PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+		handler.deleter(
+			gname, PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	case C.OTP_Query:
-		(*(*NamedPropertyQueryCallback)(info.callback))(
-			gname, PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+		handler.query(
+			gname, PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	case C.OTP_Enumerator:
-		(*(*NamedPropertyEnumeratorCallback)(info.callback))(
-			PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+		handler.enumerator(
+			PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	}
 }
 
 //export go_indexed_property_callback
-func go_indexed_property_callback(typ C.PropertyDataEnum, info *C.V8_PropertyCallbackInfo, context unsafe.Pointer) {
+func go_indexed_property_callback(typ C.PropertyDataEnum, info *C.V8_PropertyCallbackInfo, context C.V8_GoHandle) {
+	c := callbackContext(context)
+	defer c.recoverCallbackPanic()
+
+	handler := goHandle(info.callback).value().(*indexedPropertyInfo)
 	switch typ {
 	case C.OTP_Getter:
-		(*(*IndexedPropertyGetterCallback)(info.callback))(
-			uint32(info.index), PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+		handler.getter(
+			uint32(info.index), PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	case C.OTP_Setter:
-		(*(*IndexedPropertySetterCallback)(info.callback))(
+		handler.setter(
 			uint32(info.index),
-			newValue(info.setValue),
-			PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+			newValue(c.engine, info.setValue),
+			PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	case C.OTP_Deleter:
-		(*(*IndexedPropertyDeleterCallback)(info.callback))(
-			uint32(info.index), PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+		handler.deleter(
+			uint32(info.index), PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	case C.OTP_Query:
-		(*(*IndexedPropertyQueryCallback)(info.callback))(
-			uint32(info.index), PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+		handler.query(
+			uint32(info.index), PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	case C.OTP_Enumerator:
-		(*(*IndexedPropertyEnumeratorCallback)(info.callback))(
-			PropertyCallbackInfo{unsafe.Pointer(info), typ, *(*interface{})(info.data), ReturnValue{}, (*Context)(context)})
+		handler.enumerator(
+			PropertyCallbackInfo{unsafe.Pointer(info), typ, handler.data, ReturnValue{}, c})
 	}
 }
 
+// Objects wrapped by a template share the handle of its accessor, the
+// handle is released when the template is disposed.
+//
 func (o *Object) setAccessor(info *accessorInfo) {
 	keyPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&info.key)).Data)
-	var getterPointer, setterPointer unsafe.Pointer
-	if info.getter != nil {
-		getterPointer = unsafe.Pointer(&info.getter)
-	}
-
-	if info.setter != nil {
-		setterPointer = unsafe.Pointer(&info.setter)
-	}
+	h := info.handle
 	C.V8_Object_SetAccessor(
-		o.self,
+		o.ptr(),
 		(*C.char)(keyPtr), C.int(len(info.key)),
-		getterPointer,
-		setterPointer,
-		unsafe.Pointer(&(info.data)),
+		h.cIf(info.getter != nil),
+		h.cIf(info.setter != nil),
 		C.int(info.attribs),
 	)
 }
@@ -485,6 +501,14 @@ type FunctionTemplate struct {
 	callback FunctionCallback
 	data     interface{}
 	self     unsafe.Pointer
+	handle   goHandle
+}
+
+// What C calls back, registered instead of the template so the handle
+// doesn't keep the engine reachable.
+type functionInfo struct {
+	callback FunctionCallback
+	data     interface{}
 }
 
 func (e *Engine) NewFunctionTemplate(callback FunctionCallback, data interface{}) *FunctionTemplate {
@@ -495,17 +519,15 @@ func (e *Engine) NewFunctionTemplate(callback FunctionCallback, data interface{}
 		data:     data,
 	}
 
-	var callbackPtr unsafe.Pointer
+	h := e.newCallbackHandle(&functionInfo{callback, data})
 
-	if callback != nil {
-		callbackPtr = unsafe.Pointer(&(ft.callback))
-	}
-
-	self := C.V8_NewFunctionTemplate(e.self, callbackPtr, unsafe.Pointer(&data))
+	self := C.V8_NewFunctionTemplate(e.ptr(), h.cIf(callback != nil))
 	if self == nil {
+		e.deleteCallbackHandles([]goHandle{h})
 		return nil
 	}
 	ft.self = self
+	ft.handle = h
 
 	e.funcTemplateId += 1
 	e.funcTemplates[ft.id] = ft
@@ -513,12 +535,16 @@ func (e *Engine) NewFunctionTemplate(callback FunctionCallback, data interface{}
 	return ft
 }
 
+// Frees the template and releases its callback, functions created by
+// it throw when they are called afterwards.
+//
 func (ft *FunctionTemplate) Dispose() {
 	ft.Lock()
 	defer ft.Unlock()
 
 	if ft.id > 0 {
 		delete(ft.engine.funcTemplates, ft.id)
+		ft.engine.deleteCallbackHandles([]goHandle{ft.handle})
 		ft.id = 0
 		ft.engine = nil
 		C.V8_DisposeFunctionTemplate(ft.self)
@@ -533,7 +559,9 @@ func (ft *FunctionTemplate) NewFunction() *Value {
 		return nil
 	}
 
-	return newValue(C.V8_FunctionTemplate_GetFunction(ft.self))
+	result := newValue(ft.engine, C.V8_FunctionTemplate_GetFunction(ft.self))
+	ft.engine.checkAPIError()
+	return result
 }
 
 func (ft *FunctionTemplate) SetClassName(name string) {
@@ -561,30 +589,53 @@ func (ft *FunctionTemplate) InstanceTemplate() *ObjectTemplate {
 }
 
 //export go_function_callback
-func go_function_callback(info, callback, context, data unsafe.Pointer) {
-	callbackFunc := *(*func(FunctionCallbackInfo))(callback)
-	callbackFunc(FunctionCallbackInfo{info, ReturnValue{}, (*Context)(context), *(*interface{})(data)})
+func go_function_callback(info unsafe.Pointer, callback, context C.V8_GoHandle) {
+	c := callbackContext(context)
+	defer c.recoverCallbackPanic()
+
+	function := goHandle(callback).value().(*functionInfo)
+	function.callback(FunctionCallbackInfo{info, ReturnValue{}, c, function.data})
 }
 
 func (f *Function) Call(args ...*Value) *Value {
+	return f.call(args, nil)
+}
+
+// Like Call but returns the thrown exception as a *JSError.
+//
+func (f *Function) CallE(args ...*Value) (*Value, error) {
+	return f.CallContext(context.Background(), args...)
+}
+
+func (f *Function) call(args []*Value, exception **C.V8_Exception) *Value {
 	argv := make([]unsafe.Pointer, len(args))
 	for i, arg := range args {
-		argv[i] = arg.self
+		argv[i] = arg.ptrFor(f.engine)
 	}
-	return newValue(C.V8_Function_Call(
-		f.self, C.int(len(args)),
+	return newValue(f.engine, C.V8_Function_Call(
+		f.ptr(), C.int(len(args)),
 		unsafe.Pointer((*reflect.SliceHeader)(unsafe.Pointer(&argv)).Data),
+		exception,
 	))
 }
 
 // Function and property return value
 //
 type ReturnValue struct {
-	self unsafe.Pointer
+	self     unsafe.Pointer
+	engine   *Engine
+	callback unsafe.Pointer
+}
+
+func (rv ReturnValue) ptr() unsafe.Pointer {
+	if rv.callback != nil {
+		rv.engine.checkLocked(rv.callback)
+	}
+	return rv.self
 }
 
 func (rv ReturnValue) Set(value *Value) {
-	C.V8_ReturnValue_Set(rv.self, value.self)
+	C.V8_ReturnValue_Set(rv.ptr(), value.ptrFor(rv.engine))
 }
 
 func (rv ReturnValue) SetBoolean(value bool) {
@@ -592,32 +643,32 @@ func (rv ReturnValue) SetBoolean(value bool) {
 	if value {
 		valueInt = 1
 	}
-	C.V8_ReturnValue_SetBoolean(rv.self, C.int(valueInt))
+	C.V8_ReturnValue_SetBoolean(rv.ptr(), C.int(valueInt))
 }
 
 func (rv ReturnValue) SetNumber(value float64) {
-	C.V8_ReturnValue_SetNumber(rv.self, C.double(value))
+	C.V8_ReturnValue_SetNumber(rv.ptr(), C.double(value))
 }
 
 func (rv ReturnValue) SetInt32(value int32) {
-	C.V8_ReturnValue_SetInt32(rv.self, C.int32_t(value))
+	C.V8_ReturnValue_SetInt32(rv.ptr(), C.int32_t(value))
 }
 
 func (rv ReturnValue) SetUint32(value uint32) {
-	C.V8_ReturnValue_SetUint32(rv.self, C.uint32_t(value))
+	C.V8_ReturnValue_SetUint32(rv.ptr(), C.uint32_t(value))
 }
 
 func (rv ReturnValue) SetString(value string) {
 	valuePtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&value)).Data)
-	C.V8_ReturnValue_SetString(rv.self, (*C.char)(valuePtr), C.int(len(value)))
+	C.V8_ReturnValue_SetString(rv.ptr(), (*C.char)(valuePtr), C.int(len(value)))
 }
 
 func (rv ReturnValue) SetNull() {
-	C.V8_ReturnValue_SetNull(rv.self)
+	C.V8_ReturnValue_SetNull(rv.ptr())
 }
 
 func (rv ReturnValue) SetUndefined() {
-	C.V8_ReturnValue_SetUndefined(rv.self)
+	C.V8_ReturnValue_SetUndefined(rv.ptr())
 }
 
 // Function callback info
@@ -629,28 +680,33 @@ type FunctionCallbackInfo struct {
 	data        interface{}
 }
 
+func (fc FunctionCallbackInfo) ptr() unsafe.Pointer {
+	fc.context.engine.checkLocked(fc.self)
+	return fc.self
+}
+
 func (fc FunctionCallbackInfo) CurrentScope() ContextScope {
-	return ContextScope{fc.context}
+	return newContextScope(fc.context, nil)
 }
 
 func (fc FunctionCallbackInfo) Get(i int) *Value {
-	return newValue(C.V8_FunctionCallbackInfo_Get(fc.self, C.int(i)))
+	return newValue(fc.context.engine, C.V8_FunctionCallbackInfo_Get(fc.ptr(), C.int(i)))
 }
 
 func (fc FunctionCallbackInfo) Length() int {
-	return int(C.V8_FunctionCallbackInfo_Length(fc.self))
+	return int(C.V8_FunctionCallbackInfo_Length(fc.ptr()))
 }
 
 func (fc FunctionCallbackInfo) Callee() *Function {
-	return newValue(C.V8_FunctionCallbackInfo_Callee(fc.self)).ToFunction()
+	return newValue(fc.context.engine, C.V8_FunctionCallbackInfo_Callee(fc.ptr())).ToFunction()
 }
 
 func (fc FunctionCallbackInfo) This() *Object {
-	return newValue(C.V8_FunctionCallbackInfo_This(fc.self)).ToObject()
+	return newValue(fc.context.engine, C.V8_FunctionCallbackInfo_This(fc.ptr())).ToObject()
 }
 
 func (fc FunctionCallbackInfo) Holder() *Object {
-	return newValue(C.V8_FunctionCallbackInfo_Holder(fc.self)).ToObject()
+	return newValue(fc.context.engine, C.V8_FunctionCallbackInfo_Holder(fc.ptr())).ToObject()
 }
 
 func (fc FunctionCallbackInfo) Data() interface{} {
@@ -659,7 +715,87 @@ func (fc FunctionCallbackInfo) Data() interface{} {
 
 func (fc *FunctionCallbackInfo) ReturnValue() ReturnValue {
 	if fc.returnValue.self == nil {
-		fc.returnValue.self = C.V8_FunctionCallbackInfo_ReturnValue(fc.self)
+		fc.returnValue.self = C.V8_FunctionCallbackInfo_ReturnValue(fc.ptr())
+		fc.returnValue.engine = fc.context.engine
+		fc.returnValue.callback = fc.self
 	}
 	return fc.returnValue
 }
+
+// Runs the callback with the isolate unlocked, so other goroutines can
+// use the engine while it does slow Go work like I/O or waiting on a
+// channel. The callback must not touch JavaScript: values, the callback
+// info and its return value panic when used inside it. The engine is
+// locked again before Unlocked returns.
+//
+func (fc FunctionCallbackInfo) Unlocked(callback func()) {
+	fc.context.engine.runUnlocked(fc.context, fc.self, callback)
+}
+
+// Runs the callback with the isolate unlocked by the goroutine holding
+// it in a scope of c, suspending its scopes meanwhile. info is the
+// callback info that must not be used inside, or nil.
+//
+func (e *Engine) runUnlocked(c *Context, info unsafe.Pointer, callback func()) {
+	self := c.ptr()
+
+	// other goroutines start their own outermost scope meanwhile
+	depth, epoch := atomic.LoadInt32(&e.scopeDepth), atomic.LoadInt64(&e.scopeEpoch)
+	handleScope, entered := e.handleScope, e.entered
+
+	e.handles.Lock()
+	if e.unlocked == nil {
+		e.unlocked = make(map[unsafe.Pointer]bool)
+		e.suspendedEpochs = make(map[int64]bool)
+	}
+	if info != nil {
+		e.unlocked[info] = true
+	}
+	e.suspendedEpochs[epoch] = true
+	e.handles.Unlock()
+	atomic.AddInt32(&e.unlockedCount, 1)
+
+	atomic.StoreInt32(&e.scopeDepth, 0)
+	e.handleScope, e.entered = nil, nil
+
+	var p goPanic
+	wrapped := func() {
+		defer p.recover()
+		callback()
+	}
+
+	h := newGoHandle(wrapped)
+	C.V8_Context_Unlocked(self, h.c())
+	h.delete()
+
+	e.handleScope, e.entered = handleScope, entered
+	atomic.StoreInt32(&e.scopeDepth, depth)
+	atomic.StoreInt64(&e.scopeEpoch, epoch)
+
+	atomic.AddInt32(&e.unlockedCount, -1)
+	e.handles.Lock()
+	delete(e.unlocked, info)
+	delete(e.suspendedEpochs, epoch)
+	e.handles.Unlock()
+
+	p.repanic()
+}
+
+//export unlocked_callback
+func unlocked_callback(callback C.V8_GoHandle) {
+	goHandle(callback).value().(func())()
+}
+
+func (e *Engine) checkLocked(callback unsafe.Pointer) {
+	if atomic.LoadInt32(&e.unlockedCount) == 0 {
+		return
+	}
+
+	e.handles.Lock()
+	unlocked := e.unlocked[callback]
+	e.handles.Unlock()
+
+	if unlocked {
+		panic("v8: callback info used inside Unlocked")
+	}
+}
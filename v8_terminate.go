@@ -0,0 +1,133 @@
+package v8
+
+/*
+#include "v8_wrap.h"
+#include <stdlib.h>
+*/
+import "C"
+import "context"
+import "errors"
+import "sync"
+
+// Returned (wrapped) by RunContext, CallContext and EvalContext when
+// the execution was terminated because the Go context was done.
+// The error also matches the context's error with errors.Is, so both
+// errors.Is(err, ErrTerminated) and errors.Is(err, context.DeadlineExceeded)
+// work for a timeout.
+//
+var ErrTerminated = errors.New("v8: execution terminated")
+
+type terminatedError struct {
+	cause error
+}
+
+func (e *terminatedError) Error() string {
+	return ErrTerminated.Error() + ": " + e.cause.Error()
+}
+
+func (e *terminatedError) Is(target error) bool {
+	return target == ErrTerminated
+}
+
+func (e *terminatedError) Unwrap() error {
+	return e.cause
+}
+
+// Like RunE but terminates the script when ctx is cancelled or its
+// deadline expires. The engine stays usable after a termination.
+//
+func (s *Script) RunContext(ctx context.Context) (*Value, error) {
+	return runContext(ctx, s.engine, func(exception **C.V8_Exception) *Value {
+		result := newValue(s.engine, C.V8_Script_Run(s.ptr(), exception))
+		s.engine.checkAPIError()
+		return result
+	})
+}
+
+// Like CallE but terminates the function when ctx is cancelled or its
+// deadline expires. The engine stays usable after a termination.
+//
+func (f *Function) CallContext(ctx context.Context, args ...*Value) (*Value, error) {
+	return runContext(ctx, f.engine, func(exception **C.V8_Exception) *Value {
+		return f.call(args, exception)
+	})
+}
+
+// Like EvalE but terminates the script when ctx is cancelled or its
+// deadline expires. The engine stays usable after a termination.
+//
+func (cs ContextScope) EvalContext(ctx context.Context, code string) (*Value, error) {
+	script, err := cs.context.engine.CompileE([]byte(code), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return script.RunContext(ctx)
+}
+
+// Runs the callback while a watchdog goroutine waits for ctx. The
+// watchdog can only terminate the execution before the callback
+// returned, so a late cancel never hits the next script of the engine.
+//
+func runContext(ctx context.Context, e *Engine, run func(**C.V8_Exception) *Value) (*Value, error) {
+	if e.IsDead() {
+		return nil, ErrEngineDead
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, &terminatedError{err}
+	}
+
+	var (
+		mutex      sync.Mutex
+		finished   bool
+		terminated bool
+		stop       chan struct{}
+	)
+
+	if ctx.Done() != nil {
+		stop = make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				mutex.Lock()
+				if !finished {
+					C.V8_TerminateExecution(e.self)
+					terminated = true
+				}
+				mutex.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	var exception *C.V8_Exception
+	value := run(&exception)
+
+	if stop != nil {
+		mutex.Lock()
+		finished = true
+		mutex.Unlock()
+		close(stop)
+	}
+
+	if terminated {
+		C.V8_CancelTerminateExecution(e.self)
+	}
+
+	if exception != nil {
+		err := newJSError(e, exception)
+		switch {
+		case err.outOfMemory:
+			return nil, ErrOutOfMemory
+		case terminated && err.terminated:
+			return nil, &terminatedError{ctx.Err()}
+		}
+		return nil, err
+	}
+
+	if value == nil && e.IsDead() {
+		return nil, ErrEngineDead
+	}
+
+	return value, nil
+}
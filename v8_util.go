@@ -28,9 +28,20 @@ func (cs ContextScope) Eval(code string) *Value {
 	return nil
 }
 
+// Like Eval but returns the syntax error or the thrown exception as
+// a *JSError.
+//
+func (cs ContextScope) EvalE(code string) (*Value, error) {
+	script, err := cs.context.engine.CompileE([]byte(code), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return script.RunE()
+}
+
 func (cs ContextScope) ParseJSON(json string) *Value {
 	jsonPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&json)).Data)
-	return newValue(C.V8_ParseJSON(cs.context.self, (*C.char)(jsonPtr), C.int(len(json))))
+	return newValue(cs.context.engine, C.V8_ParseJSON(cs.ptr(), (*C.char)(jsonPtr), C.int(len(json))))
 }
 
 func ToJSON(value *Value) []byte {
@@ -122,6 +133,8 @@ type ArrayBufferFreeCallback func(unsafe.Pointer, int)
 
 type ArrayBufferAllocator struct {
 	self unsafe.Pointer
+	ac   goHandle
+	fc   goHandle
 }
 
 // Call this to get a new ArrayBufferAllocator
@@ -131,9 +144,6 @@ func newArrayBufferAllocator() *ArrayBufferAllocator {
 		if allocator.self == nil {
 			return
 		}
-		if traceDispose {
-			println("dispose array buffer allocator", allocator.self)
-		}
 		C.V8_Dispose_Allocator(allocator.self)
 	})
 	return allocator
@@ -146,30 +156,37 @@ func newArrayBufferAllocator() *ArrayBufferAllocator {
 func SetArrayBufferAllocator(
 	ac ArrayBufferAllocateCallback,
 	fc ArrayBufferFreeCallback) {
-	var acPointer, fcPointer unsafe.Pointer
-	if ac != nil {
-		acPointer = unsafe.Pointer(&ac)
-	}
-	if fc != nil {
-		fcPointer = unsafe.Pointer(&fc)
-	}
-
 	gMutex.Lock()
 	defer gMutex.Unlock()
+
+	// the allocator only keeps the latest callbacks
+	gAllocator.ac.delete()
+	gAllocator.fc.delete()
+
+	gAllocator.ac = newGoHandle(ac)
+	gAllocator.fc = newGoHandle(fc)
+
 	gAllocator.self = C.V8_SetArrayBufferAllocator(
 		gAllocator.self,
-		acPointer,
-		fcPointer)
+		gAllocator.ac.cIf(ac != nil),
+		gAllocator.fc.cIf(fc != nil))
 }
 
+// The allocator is global, a panic is reported to the engine of the
+// thread and fails the allocation.
+//
 //export go_array_buffer_allocate
-func go_array_buffer_allocate(callback unsafe.Pointer, length C.size_t, initialized C.int) unsafe.Pointer {
-	return (*(*ArrayBufferAllocateCallback)(callback))(int(length), initialized != 0)
+func go_array_buffer_allocate(callback C.V8_GoHandle, length C.size_t, initialized C.int, engine C.int) unsafe.Pointer {
+	defer lookupHooks(engine).recoverPanic()
+
+	return goHandle(callback).value().(ArrayBufferAllocateCallback)(int(length), initialized != 0)
 }
 
 //export go_array_buffer_free
-func go_array_buffer_free(callback unsafe.Pointer, data unsafe.Pointer, length C.size_t) {
-	(*(*ArrayBufferFreeCallback)(callback))(data, int(length))
+func go_array_buffer_free(callback C.V8_GoHandle, data unsafe.Pointer, length C.size_t, engine C.int) {
+	defer lookupHooks(engine).recoverPanic()
+
+	goHandle(callback).value().(ArrayBufferFreeCallback)(data, int(length))
 }
 
 func SetCaptureStackTraceForUncaughtExceptions(capture bool, frameLimit int) {
@@ -8,58 +8,129 @@ import "C"
 import "unsafe"
 import "runtime"
 import "reflect"
+import "sync/atomic"
+import "time"
 
 // The superclass of all JavaScript values and objects.
 //
 type Value struct {
 	self    unsafe.Pointer
+	engine  *Engine
+	scope   *handleScope
+	epoch   int64
 	isType  int
 	notType int
 }
 
-func newValue(self unsafe.Pointer) *Value {
+func newValue(engine *Engine, self unsafe.Pointer) *Value {
 	if self == nil {
 		return nil
 	}
 
 	result := &Value{
-		self: self,
+		self:   self,
+		engine: engine,
 	}
 
-	runtime.SetFinalizer(result, func(v *Value) {
-		if traceDispose {
-			println("v8.Value.Dispose()", v.self)
-		}
-		C.V8_DisposeValue(v.self)
-	})
+	atomic.AddInt64(&engine.valueCount, 1)
+
+	if atomic.LoadInt32(&engine.scopeDepth) > 0 {
+		result.epoch = atomic.LoadInt64(&engine.scopeEpoch)
+	}
+
+	if scope := engine.handleScope; scope != nil {
+		scope.add(result)
+	} else {
+		result.setFinalizer()
+	}
 
 	return result
 }
 
+// The engine caches undefined, null, true and false, so they never
+// belong to a handle scope. They are freed by Dispose, a finalizer
+// would keep the engine alive through the reference cycle.
+//
+func newConstant(engine *Engine, self unsafe.Pointer) *Value {
+	return &Value{
+		self:   self,
+		engine: engine,
+	}
+}
+
+func (v *Value) setFinalizer() {
+	runtime.SetFinalizer(v, func(v *Value) {
+		atomic.AddInt64(&v.engine.valueCount, -1)
+		v.engine.queueValue(v.self)
+	})
+}
+
+func (v *Value) ptr() unsafe.Pointer {
+	e := v.engine
+	e.ptr()
+	if v.self == nil {
+		panic("v8: value used after its handle scope ended")
+	}
+	if v.epoch != 0 && (atomic.LoadInt32(&e.scopeDepth) == 0 || atomic.LoadInt64(&e.scopeEpoch) != v.epoch) {
+		if e.isSuspended(v.epoch) {
+			panic("v8: value used inside Unlocked")
+		}
+		panic("v8: value used outside of its context scope")
+	}
+	if debugScopes {
+		if atomic.LoadInt32(&e.scopeDepth) == 0 {
+			panic("v8: value used outside of a context scope")
+		}
+		// the scope is open, but maybe on another goroutine
+		if C.V8_IsLockedByThread(e.ptr()) == 0 {
+			panic("v8: value used by a goroutine outside of its context scope")
+		}
+	}
+	return v.self
+}
+
+func (e *Engine) isSuspended(epoch int64) bool {
+	if atomic.LoadInt32(&e.unlockedCount) == 0 {
+		return false
+	}
+
+	e.handles.Lock()
+	defer e.handles.Unlock()
+
+	return e.suspendedEpochs[epoch]
+}
+
+// For values passed to a wrapper of the engine e.
+//
+func (v *Value) ptrFor(e *Engine) unsafe.Pointer {
+	e.checkOwner(v.engine, "value")
+	return v.ptr()
+}
+
 func (e *Engine) Undefined() *Value {
 	if e._undefined == nil {
-		e._undefined = newValue(C.V8_Undefined(e.self))
+		e._undefined = newConstant(e, C.V8_Undefined(e.ptr()))
 	}
 	return e._undefined
 }
 
 func (e *Engine) Null() *Value {
 	if e._null == nil {
-		e._null = newValue(C.V8_Null(e.self))
+		e._null = newConstant(e, C.V8_Null(e.ptr()))
 	}
 	return e._null
 }
 
 func (e *Engine) True() *Value {
 	if e._true == nil {
-		e._true = newValue(C.V8_True(e.self))
+		e._true = newConstant(e, C.V8_True(e.ptr()))
 	}
 	return e._true
 }
 
 func (e *Engine) False() *Value {
 	if e._false == nil {
-		e._false = newValue(C.V8_False(e.self))
+		e._false = newConstant(e, C.V8_False(e.ptr()))
 	}
 	return e._false
 }
@@ -72,46 +143,61 @@ func (cs ContextScope) NewBoolean(value bool) *Value {
 }
 
 func (cs ContextScope) NewNumber(value float64) *Value {
-	return newValue(C.V8_NewNumber(
-		cs.context.self, C.double(value),
+	return newValue(cs.context.engine, C.V8_NewNumber(
+		cs.ptr(), C.double(value),
 	))
 }
 
 func (cs ContextScope) NewInteger(value int64) *Value {
-	return newValue(C.V8_NewNumber(
-		cs.context.self, C.double(value),
+	return newValue(cs.context.engine, C.V8_NewNumber(
+		cs.ptr(), C.double(value),
 	))
 }
 
 func (cs ContextScope) NewString(value string) *Value {
 	valPtr := unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&value)).Data)
-	return newValue(C.V8_NewString(
-		cs.context.self, (*C.char)(valPtr), C.int(len(value)),
+	return newValue(cs.context.engine, C.V8_NewString(
+		cs.ptr(), (*C.char)(valPtr), C.int(len(value)),
 	))
 }
 
+// Creates a Date object for the given time. Dates only keep
+// millisecond precision.
+//
+func (cs ContextScope) NewDate(value time.Time) *Value {
+	return newValue(cs.context.engine, C.V8_NewDate(
+		cs.ptr(), C.double(value.UnixMilli()),
+	))
+}
+
+// The === operator, objects are only equal to themselves.
+//
+func (v *Value) strictEquals(other *Value) bool {
+	return C.V8_Value_StrictEquals(v.ptr(), other.ptrFor(v.engine)) == 1
+}
+
 func (v *Value) ToBoolean() bool {
-	return C.V8_Value_ToBoolean(v.self) == 1
+	return C.V8_Value_ToBoolean(v.ptr()) == 1
 }
 
 func (v *Value) ToNumber() float64 {
-	return float64(C.V8_Value_ToNumber(v.self))
+	return float64(C.V8_Value_ToNumber(v.ptr()))
 }
 
 func (v *Value) ToInteger() int64 {
-	return int64(C.V8_Value_ToInteger(v.self))
+	return int64(C.V8_Value_ToInteger(v.ptr()))
 }
 
 func (v *Value) ToUint32() uint32 {
-	return uint32(C.V8_Value_ToUint32(v.self))
+	return uint32(C.V8_Value_ToUint32(v.ptr()))
 }
 
 func (v *Value) ToInt32() int32 {
-	return int32(C.V8_Value_ToInt32(v.self))
+	return int32(C.V8_Value_ToInt32(v.ptr()))
 }
 
 func (v *Value) ToString() string {
-	cstring := C.V8_Value_ToString(v.self)
+	cstring := C.V8_Value_ToString(v.ptr())
 	gostring := C.GoString(cstring)
 	C.free(unsafe.Pointer(cstring))
 	return gostring
@@ -176,7 +262,7 @@ func (v *Value) checkJsType(typeCode int, check func(unsafe.Pointer) bool) bool
 		return false
 	}
 
-	if check(v.self) {
+	if check(v.ptr()) {
 		v.isType |= typeCode
 		return true
 	} else {
@@ -0,0 +1,151 @@
+package v8
+
+/*
+#include "v8_wrap.h"
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+import "sync"
+
+// C only holds the id of a weak reference, the Go side is looked up
+// when the object dies.
+type weakRef struct {
+	engine   *Engine
+	callback func(*Object)
+	data     goHandle
+}
+
+var (
+	weakMutex sync.Mutex
+	weakId    int
+	weakRefs  = make(map[int]*weakRef)
+
+	// the weak reference that releases an internal field value
+	weakData = make(map[goHandle]int)
+)
+
+// Calls the callback when V8 garbage collects the object. It runs
+// inside the GC on the goroutine that holds the engine at that time.
+// The object passed is only valid during the callback, it is freed
+// when the callback returns and using it later panics. A pending callback keeps the engine reachable until it ran
+// or the engine is disposed.
+//
+func (o *Object) SetWeak(callback func(*Object)) {
+	o.setWeak(callback, 0)
+}
+
+func (o *Object) setWeak(callback func(*Object), data goHandle) {
+	weakMutex.Lock()
+	weakId += 1
+	id := weakId
+	weakRefs[id] = &weakRef{o.engine, callback, data}
+	if data != 0 {
+		weakData[data] = id
+	}
+	weakMutex.Unlock()
+
+	C.V8_Object_SetWeak(o.engine.ptr(), o.ptr(), C.int(id))
+}
+
+// Creates an object that holds value in its first internal field, so
+// GetInternalField(0) returns it. Go keeps the value alive for as long
+// as the object lives in V8 or the field isn't set again. The template
+// needs an internal field.
+//
+func (ot *ObjectTemplate) NewWrapped(value interface{}) *Object {
+	result := ot.NewObject()
+	if result == nil {
+		return nil
+	}
+
+	object := result.ToObject()
+
+	if object.InternalFieldCount() < 1 {
+		panic("v8: NewWrapped needs an object template with an internal field")
+	}
+
+	object.SetInternalField(0, value)
+
+	return object
+}
+
+// Moves the weak reference of an overwritten internal field value to
+// the new value, or drops it when data is zero. The old value is
+// released right away.
+//
+func replaceWeakData(old, data goHandle) bool {
+	weakMutex.Lock()
+	id, ok := weakData[old]
+	if ok {
+		delete(weakData, old)
+		weakRefs[id].data = data
+		if data != 0 {
+			weakData[data] = id
+		}
+	}
+	weakMutex.Unlock()
+
+	old.delete()
+
+	return ok
+}
+
+//export go_weak_callback
+func go_weak_callback(id C.int, value unsafe.Pointer) {
+	weakMutex.Lock()
+	ref := weakRefs[int(id)]
+	delete(weakRefs, int(id))
+	if ref != nil {
+		delete(weakData, ref.data)
+	}
+	weakMutex.Unlock()
+
+	if ref == nil {
+		C.V8_DisposeValue(value)
+		return
+	}
+
+	e := ref.engine
+
+	// must not unwind through the GC
+	defer e.hooks.recoverPanic()
+
+	// the value lives in the handle scope of the GC callback, so it is
+	// freed when the callback returns and later use panics
+	object := &Object{&Value{self: value, engine: e}}
+	defer func() {
+		object.self = nil
+		C.V8_DisposeValue(value)
+	}()
+
+	if ref.data != 0 {
+		// other weak callbacks of the object may still read the
+		// internal field, so the value is dropped with the next queue
+		e.releaseData(ref.data)
+	}
+
+	if ref.callback != nil {
+		ref.callback(object)
+	}
+}
+
+func (e *Engine) removeWeakRefs() {
+	weakMutex.Lock()
+	defer weakMutex.Unlock()
+
+	for id, ref := range weakRefs {
+		if ref.engine == e {
+			ref.data.delete()
+			delete(weakData, ref.data)
+			delete(weakRefs, id)
+		}
+	}
+}
+
+// Forces a full garbage collection, which also runs the weak callbacks
+// of the collected objects.
+//
+func (e *Engine) LowMemoryNotification() {
+	C.V8_Engine_LowMemoryNotification(e.ptr())
+}
@@ -1,8 +1,11 @@
+#include <algorithm>
 #include <cstdlib>
 #include <cstring>
 #include <sstream>
 #include <iostream>
 #include <string>
+#include <vector>
+#include <pthread.h>
 #include "v8.h"
 #include "v8_wrap.h"
 
@@ -186,20 +189,152 @@ void* new_V8_Value(V8_Context* context, Handle<Value> value) {
 /*
 engine
 */
-void* V8_NewEngine() {
+typedef struct scope_data {
+	void* context;
+	V8_GoHandle context_handle;
+	int         callback_depth;
+} scope_data;
+
+struct V8_WeakHandle;
+
+// Stored in the isolate's data slot for the engine's lifetime.
+typedef struct isolate_data {
+	scope_data*       scope;
+	V8_WeakHandle*    weak_handles;
+	int               engine_id;
+	int               stack_limit;
+	uintptr_t         stack_limit_address;
+	int               near_heap_limit;
+	int               out_of_memory;
+	int               dead;
+	const char*       api_error;
+	pthread_mutex_t   heap_mutex;
+	V8_HeapStatistics heap_statistics;
+} isolate_data;
+
+isolate_data* V8_IsolateData(Isolate* isolate) {
+	return static_cast<isolate_data*>(isolate->GetData());
+}
+
+// Keeps a copy of the heap statistics that can be read without
+// locking the isolate. Must be called with the isolate locked.
+void V8_UpdateHeapStatistics(Isolate* isolate, HeapStatistics* stats) {
+	isolate_data* data = V8_IsolateData(isolate);
+
+	isolate->GetHeapStatistics(stats);
+
+	if (data == NULL)
+		return;
+
+	pthread_mutex_lock(&data->heap_mutex);
+	data->heap_statistics.total_heap_size = stats->total_heap_size();
+	data->heap_statistics.total_heap_size_executable = stats->total_heap_size_executable();
+	data->heap_statistics.total_physical_size = stats->total_physical_size();
+	data->heap_statistics.used_heap_size = stats->used_heap_size();
+	data->heap_statistics.heap_size_limit = stats->heap_size_limit();
+	pthread_mutex_unlock(&data->heap_mutex);
+}
+
+scope_data* V8_Current_Scope(Isolate* isolate) {
+	isolate_data* data = V8_IsolateData(isolate);
+	return data == NULL ? NULL : data->scope;
+}
+
+// Heap usage ratio that makes a GC ask Go whether to terminate.
+const double kNearHeapLimitRatio = 0.9;
+
+// There is no near heap limit callback in this V8, so the heap usage
+// is checked after every GC instead. Terminating only stops the
+// script at its next stack guard check, a single huge allocation can
+// still hit the real limit.
+void V8_GCEpilogue(Isolate* isolate, GCType type, GCCallbackFlags flags) {
+	HeapStatistics stats;
+	V8_UpdateHeapStatistics(isolate, &stats);
+
+	isolate_data* data = V8_IsolateData(isolate);
+	if (data == NULL || !data->near_heap_limit || data->out_of_memory)
+		return;
+
+	size_t used = stats.used_heap_size();
+	size_t limit = stats.heap_size_limit();
+
+	if (used < limit * kNearHeapLimitRatio)
+		return;
+
+	if (go_near_heap_limit(data->engine_id, used, limit)) {
+		data->out_of_memory = 1;
+		V8::TerminateExecution(isolate);
+	}
+}
+
+// Called by V8 instead of aborting on API misuse and other fatal
+// errors. The engine is unusable afterwards. Out of memory errors
+// still abort the process once this returns.
+void V8_FatalErrorCallback(const char* location, const char* message) {
+	Isolate* isolate = Isolate::GetCurrent();
+
+	if (isolate != NULL) {
+		isolate_data* data = V8_IsolateData(isolate);
+		if (data != NULL)
+			data->dead = 1;
+	}
+
+	go_fatal_error((char*)location, (char*)message);
+}
+
+int V8_IsDead(void* context) {
+	isolate_data* data = V8_IsolateData(static_cast<V8_Context*>(context)->GetIsolate());
+	return data != NULL && data->dead;
+}
+
+void* V8_NewEngine(V8_EngineOptions* options) {
 	ISOLATE_SCOPE(Isolate::New());
 
+	// The handler belongs to the isolate entered above.
+	V8::SetFatalErrorHandler(V8_FatalErrorCallback);
+
+	isolate_data* data = (isolate_data*)calloc(1, sizeof(isolate_data));
+	pthread_mutex_init(&data->heap_mutex, NULL);
+	isolate->SetData(data);
+
+	if (options != NULL) {
+		// Heap constraints must be set before the heap is initialized,
+		// which happens with the first context below.
+		if (options->max_young_space > 0 || options->max_old_space > 0 || options->max_executable > 0) {
+			ResourceConstraints constraints;
+			constraints.set_max_young_space_size(options->max_young_space);
+			constraints.set_max_old_space_size(options->max_old_space);
+			constraints.set_max_executable_size(options->max_executable);
+			SetResourceConstraints(isolate, &constraints);
+		}
+
+		data->engine_id = options->engine_id;
+		data->stack_limit = options->stack_limit;
+		data->near_heap_limit = options->near_heap_limit;
+	}
+
 	HandleScope handle_scope(isolate);
 	Handle<Context> context = Context::New(isolate);
 
-	if (context.IsEmpty())
+	if (context.IsEmpty()) {
+		isolate->SetData(NULL);
+		pthread_mutex_destroy(&data->heap_mutex);
+		free(data);
 		return NULL;
+	}
+
+	isolate->AddGCEpilogueCallback(V8_GCEpilogue);
+
+	HeapStatistics stats;
+	V8_UpdateHeapStatistics(isolate, &stats);
 
 	context->Enter();
 
 	return (void*)(new V8_Context(isolate, context));
 }
 
+void V8_DisposeWeakHandles(Isolate* isolate);
+
 void V8_DisposeEngine(void* engine) {
 	V8_Context* the_engine = static_cast<V8_Context*>(engine);
 	ISOLATE_SCOPE(the_engine->GetIsolate());
@@ -207,11 +342,47 @@ void V8_DisposeEngine(void* engine) {
 
 	local_context->Exit();
 
+	V8_DisposeWeakHandles(isolate);
+
 	delete the_engine;
 
+	isolate_data* data = V8_IsolateData(isolate);
+	isolate->SetData(NULL);
+	pthread_mutex_destroy(&data->heap_mutex);
+	free(data);
+
 	isolate->Dispose();
 }
 
+// Frees the handles queued by the Go finalizers, taking the isolate
+// lock once for all of them.
+void V8_Engine_DisposeHandles(void* engine, void** values, int value_count, void** scripts, int script_count, void** contexts, int context_count) {
+	ENGINE_SCOPE(engine);
+
+	for (int i = 0; i < value_count; i ++)
+		delete static_cast<V8_Value*>(values[i]);
+
+	for (int i = 0; i < script_count; i ++)
+		delete static_cast<V8_Script*>(scripts[i]);
+
+	for (int i = 0; i < context_count; i ++)
+		delete static_cast<V8_Context*>(contexts[i]);
+}
+
+void V8_Engine_LowMemoryNotification(void* engine) {
+	ENGINE_SCOPE(engine);
+	V8::LowMemoryNotification();
+}
+
+void V8_Engine_HeapStatistics(void* engine, V8_HeapStatistics* stats) {
+	V8_Context* the_engine = static_cast<V8_Context*>(engine);
+	isolate_data* data = V8_IsolateData(the_engine->GetIsolate());
+
+	pthread_mutex_lock(&data->heap_mutex);
+	*stats = data->heap_statistics;
+	pthread_mutex_unlock(&data->heap_mutex);
+}
+
 void* V8_ParseJSON(void* context, const char* json, int json_length) {
 	CONTEXT_SCOPE(context);
 
@@ -251,46 +422,247 @@ void V8_DisposeContext(void* context) {
 	delete static_cast<V8_Context*>(context);
 }
 
-typedef struct scope_data {
-	void* context;
-	void* context_ptr;
-} scope_data;
+// Counts the Go callbacks running on top of JavaScript frames, so an
+// exception thrown from Go knows whether JavaScript will receive it.
+class GoCallbackScope {
+public:
+	GoCallbackScope(Isolate* isolate) {
+		data_ = V8_Current_Scope(isolate);
+		if (data_ != NULL)
+			data_->callback_depth++;
+	}
+
+	~GoCallbackScope() {
+		if (data_ != NULL)
+			data_->callback_depth--;
+	}
+
+private:
+	scope_data* data_;
+};
+
+void V8_SetStackLimit(Isolate* isolate, uintptr_t address) {
+	ResourceConstraints constraints;
+	constraints.set_stack_limit(reinterpret_cast<uint32_t*>(address));
+	SetResourceConstraints(isolate, &constraints);
+	V8_IsolateData(isolate)->stack_limit_address = address;
+}
 
-void V8_Context_Scope(void* context, void* context_ptr, void* callback) {
+void V8_EnterOutermostScope(Isolate* isolate) {
+	isolate_data* the_data = V8_IsolateData(isolate);
+
+	// The stack limit is per thread, so it is set relative to the
+	// current stack whenever a thread enters the outermost scope.
+	if (the_data->stack_limit > 0) {
+		uintptr_t here = reinterpret_cast<uintptr_t>(&the_data);
+		V8_SetStackLimit(isolate, here - the_data->stack_limit);
+	}
+
+	the_data->out_of_memory = 0;
+}
+
+// Other threads can use the isolate while the Go callback runs, they
+// see no current scope and set their own stack limit, so both are
+// restored once the isolate is locked again.
+void V8_Context_Unlocked(void* context, V8_GoHandle callback) {
+	V8_Context* ctx = static_cast<V8_Context*>(context);
+	Isolate* isolate = ctx->GetIsolate();
+	isolate_data* the_data = V8_IsolateData(isolate);
+
+	scope_data* scope = the_data->scope;
+	uintptr_t stack_limit_address = the_data->stack_limit_address;
+	the_data->scope = NULL;
+
+	{
+		Unlocker unlocker(isolate);
+		unlocked_callback(callback);
+	}
+
+	the_data->scope = scope;
+	if (the_data->stack_limit > 0)
+		V8_SetStackLimit(isolate, stack_limit_address);
+}
+
+int V8_IsLockedByThread(void* engine) {
+	V8_Context* the_engine = static_cast<V8_Context*>(engine);
+	return Locker::IsLocked(the_engine->GetIsolate()) ? 1 : 0;
+}
+
+// The state of V8_Context_Scope kept on the heap, so the scope can stay
+// open across calls from Go. Go pins the goroutine to its thread until
+// V8_Context_Exit, because the locker belongs to the thread.
+typedef struct V8_EnteredScope {
+	Locker*     locker;
+	pthread_t   thread;
+	scope_data  data;
+	scope_data* prev;
+	bool        has_handle_scope;
+	// HandleScope refuses heap allocation, so it lives here in place
+	union {
+		char  bytes[sizeof(HandleScope)];
+		void* align;
+	} handle_scope;
+} V8_EnteredScope;
+
+void* V8_Context_Enter(void* context, V8_GoHandle context_handle) {
+	V8_Context* ctx = static_cast<V8_Context*>(context);
+	Isolate* isolate = ctx->GetIsolate();
+
+	V8_EnteredScope* scope = new V8_EnteredScope();
+	scope->locker = new Locker(isolate);
+	scope->thread = pthread_self();
+	isolate->Enter();
+
+	isolate_data* the_data = V8_IsolateData(isolate);
+	scope->prev = the_data->scope;
+	scope->data.context = context;
+	scope->data.context_handle = context_handle;
+	scope->data.callback_depth = 0;
+	the_data->scope = &scope->data;
+
+	scope->has_handle_scope = scope->prev == NULL;
+	if (scope->has_handle_scope) {
+		V8_EnterOutermostScope(isolate);
+		::new (scope->handle_scope.bytes) HandleScope(isolate);
+	}
+
+	Local<Context>::New(isolate, ctx->self)->Enter();
+
+	return scope;
+}
+
+int V8_Context_EnteredByThread(void* scope_ptr) {
+	V8_EnteredScope* scope = static_cast<V8_EnteredScope*>(scope_ptr);
+	return pthread_equal(scope->thread, pthread_self()) ? 1 : 0;
+}
+
+void V8_Context_Exit(void* scope_ptr) {
+	V8_EnteredScope* scope = static_cast<V8_EnteredScope*>(scope_ptr);
+	V8_Context* ctx = static_cast<V8_Context*>(scope->data.context);
+	Isolate* isolate = ctx->GetIsolate();
+
+	{
+		HandleScope handle_scope(isolate);
+		Local<Context>::New(isolate, ctx->self)->Exit();
+	}
+
+	if (scope->has_handle_scope) {
+		reinterpret_cast<HandleScope*>(scope->handle_scope.bytes)->~HandleScope();
+
+		HeapStatistics stats;
+		V8_UpdateHeapStatistics(isolate, &stats);
+	}
+
+	V8_IsolateData(isolate)->scope = scope->prev;
+
+	isolate->Exit();
+	delete scope->locker;
+	delete scope;
+}
+
+void V8_Context_Scope(void* context, V8_GoHandle context_handle, V8_GoHandle callback) {
 	V8_Context* ctx = static_cast<V8_Context*>(context);
 	ISOLATE_SCOPE(ctx->GetIsolate());
 
-	void* prev_context = isolate->GetData();
+	isolate_data* the_data = V8_IsolateData(isolate);
+	scope_data* prev_context = the_data->scope;
 	scope_data data;
 	data.context = context;
-	data.context_ptr = context_ptr;
-	isolate->SetData(&data);
+	data.context_handle = context_handle;
+	data.callback_depth = 0;
+	the_data->scope = &data;
 
 	// Make nested context scropt use the outermost HandleScope
 	if (prev_context == NULL) {
+		V8_EnterOutermostScope(isolate);
+
 		HandleScope handle_scope(isolate);
 		Context::Scope scope(Local<Context>::New(isolate, ctx->self));
-		context_scope_callback(context_ptr, callback);
+		context_scope_callback(context_handle, callback);
+
+		HeapStatistics stats;
+		V8_UpdateHeapStatistics(isolate, &stats);
 	} else {
 		Context::Scope scope(Local<Context>::New(isolate, ctx->self));
-		context_scope_callback(context_ptr, callback);
+		context_scope_callback(context_handle, callback);
 	}
 
-	isolate->SetData(prev_context);
+	the_data->scope = prev_context;
 }
 
+// The values escaped from a handle scope are kept alive by persistent
+// handles until the scope is closed, then they get a new local handle
+// in the enclosing scope.
+typedef struct handle_scope_data {
+	std::vector<std::pair<V8_Value*, Persistent<Value>*> > escaped;
+} handle_scope_data;
+
+void V8_HandleScope(void* context, V8_GoHandle callback) {
+	V8_Context* ctx = static_cast<V8_Context*>(context);
+	ISOLATE_SCOPE(ctx->GetIsolate());
+
+	handle_scope_data data;
+
+	{
+		HandleScope handle_scope(isolate);
+		handle_scope_callback(callback, &data);
+	}
+
+	for (size_t i = 0; i < data.escaped.size(); i ++) {
+		V8_Value* the_value = data.escaped[i].first;
+		Persistent<Value>* escaped = data.escaped[i].second;
+		the_value->self = Local<Value>::New(isolate, *escaped);
+		escaped->Reset();
+		delete escaped;
+	}
+}
+
+void V8_HandleScope_Escape(void* scope, void* value) {
+	handle_scope_data* data = static_cast<handle_scope_data*>(scope);
+	VALUE_SCOPE(value);
+
+	data->escaped.push_back(std::make_pair(the_value, new Persistent<Value>(isolate, local_value)));
+}
+
+const char* kNoScopeError = "Please call this API in a context scope";
+
+// Returns NULL outside of a context scope, the API error is then
+// picked up by the Go side with V8_Engine_TakeAPIError.
 V8_Context* V8_Current_Context(Isolate* isolate) {
-	void* data = isolate->GetData();
-	if (data == NULL)
-		v8_panic((char*)"Please call this API in a context scope");
-	return static_cast<V8_Context*>(static_cast<scope_data*>(isolate->GetData())->context);
+	scope_data* data = V8_Current_Scope(isolate);
+	if (data == NULL) {
+		isolate_data* the_data = V8_IsolateData(isolate);
+		if (the_data != NULL)
+			the_data->api_error = kNoScopeError;
+		return NULL;
+	}
+	return static_cast<V8_Context*>(data->context);
+}
+
+V8_GoHandle V8_Current_ContextHandle(Isolate* isolate) {
+	scope_data* data = V8_Current_Scope(isolate);
+	return data == NULL ? 0 : data->context_handle;
+}
+
+// Go callbacks need the Go context of the current scope. Without one,
+// e.g. for a Function.Call outside of Context.Scope, the callback is
+// skipped and the script gets an exception instead.
+bool V8_CheckCallbackScope(Isolate* isolate) {
+	if (V8_Current_Scope(isolate) != NULL)
+		return true;
+
+	isolate->ThrowException(Exception::Error(String::NewFromUtf8(isolate, kNoScopeError)));
+	return false;
 }
 
-void* V8_Current_ContextPtr(Isolate* isolate) {
-	void* data = isolate->GetData();
+const char* V8_Engine_TakeAPIError(void* engine) {
+	isolate_data* data = V8_IsolateData(static_cast<V8_Context*>(engine)->GetIsolate());
 	if (data == NULL)
-		v8_panic((char*)"Please call this API in a context scope");
-	return static_cast<scope_data*>(isolate->GetData())->context_ptr;
+		return NULL;
+
+	const char* error = data->api_error;
+	data->api_error = NULL;
+	return error;
 }
 
 void* V8_Context_Global(void* context) {
@@ -304,22 +676,63 @@ const char* ToCString(const String::Utf8Value& value) {
   return *value ? *value : "<string conversion failed>";
 }
 
-void V8_Context_ThrowException(void* context, const char* err, int err_length) {
+void V8_Context_ThrowException(void* context, void* value) {
 	V8_Context* ctx = static_cast<V8_Context*>(context);
 	ISOLATE_SCOPE(ctx->GetIsolate());
 
-	isolate->ThrowException(
-		String::NewFromOneByte(isolate, (uint8_t*)err, String::kNormalString, err_length)
+	Handle<Value> exception = static_cast<V8_Value*>(value)->self;
+	scope_data* data = V8_Current_Scope(isolate);
+
+	if (data != NULL && data->callback_depth > 0) {
+		isolate->ThrowException(exception);
+		return;
+	}
+
+	// Isolate::ThrowException only schedules the exception, and it is
+	// promoted when control returns to JavaScript. With no JavaScript
+	// frame below us nothing consumes it, so it stays scheduled and
+	// makes the next API call that enters JavaScript fail (this is why
+	// FunctionTemplate::GetFunction returned NULL). Rethrow it from a
+	// tiny function instead, which reports it like any script error.
+	HandleScope handle_scope(isolate);
+	Local<Context> local_context = Local<Context>::New(isolate, ctx->self);
+	Handle<Script> thrower = Script::Compile(
+		String::NewFromUtf8(isolate, "(function(e) { throw e; })")
 	);
+	Handle<Function>::Cast(thrower->Run())->Call(local_context->Global(), 1, &exception);
+}
+
+void* V8_Context_NewError(void* context, const char* message, int message_length, ErrorTypeEnum type) {
+	CONTEXT_SCOPE(context);
+
+	Handle<String> the_message = String::NewFromOneByte(isolate, (uint8_t*)message, String::kNormalString, message_length);
+
+	switch (type) {
+	case ET_TypeError:
+		return new_V8_Value(the_context, Exception::TypeError(the_message));
+	case ET_RangeError:
+		return new_V8_Value(the_context, Exception::RangeError(the_message));
+	case ET_SyntaxError:
+		return new_V8_Value(the_context, Exception::SyntaxError(the_message));
+	case ET_ReferenceError:
+		return new_V8_Value(the_context, Exception::ReferenceError(the_message));
+	default:
+		return new_V8_Value(the_context, Exception::Error(the_message));
+	}
 }
 
-char* V8_Message_ToString(Handle<Message>& message, Handle<Value>& exception, bool simple) {
-	String::Utf8Value exception_string(exception);
+// Builds the text report of a caught exception: the exception alone
+// when simple, otherwise with its location, source line and stack.
+char* V8_TryCatch_Report(TryCatch& try_catch, bool simple) {
+	String::Utf8Value exception(try_catch.Exception());
+	const char* exception_string = ToCString(exception);
+	Handle<Message> message = try_catch.Message();
+
 	if (message.IsEmpty() || simple) {
 		// V8 didn't provide any extra information about this error; just
 		// print the exception.
-		char *cstr = (char*)malloc(exception_string.length() + 1);
-		std::strcpy(cstr, *exception_string);
+		char *cstr = (char*)malloc(strlen(exception_string) + 1);
+		std::strcpy(cstr, exception_string);
 		return cstr;
 	}
 
@@ -329,7 +742,7 @@ char* V8_Message_ToString(Handle<Message>& message, Handle<Value>& exception, bo
 	String::Utf8Value filename(message->GetScriptResourceName());
 	const char* filename_string = ToCString(filename);
 	int linenum = message->GetLineNumber();
-	report << filename_string << ":" << linenum << ":" << *exception_string << std::endl;
+	report << filename_string << ":" << linenum << ": " << exception_string << std::endl;
 
 	// Print line of source code.
 	String::Utf8Value sourceline(message->GetSourceLine());
@@ -349,12 +762,10 @@ char* V8_Message_ToString(Handle<Message>& message, Handle<Value>& exception, bo
 
 	report << std::endl;
 
-	Handle<StackTrace> stackTrace = message->GetStackTrace();
-	for(int i = 0; i < stackTrace->GetFrameCount(); i++) {
-		Handle<StackFrame> frame = stackTrace->GetFrame(i);
-		String::Utf8Value script(frame->GetScriptNameOrSourceURL());
-		String::Utf8Value function(frame->GetFunctionName());
-		report << ToCString(script) << ":" << frame->GetLineNumber() << ToCString(function) << std::endl; 
+	String::Utf8Value stack_trace(try_catch.StackTrace());
+	if (stack_trace.length() > 0) {
+		const char* stack_trace_string = ToCString(stack_trace);
+		report << stack_trace_string << std::endl;
 	}
 
 	std::string report_string = report.str();
@@ -364,7 +775,7 @@ char* V8_Message_ToString(Handle<Message>& message, Handle<Value>& exception, bo
 	return cstr;
 }
 
-char* V8_Context_TryCatch(void* context, void* callback, int simple) {
+char* V8_Context_TryCatch(void* context, V8_GoHandle callback, int simple) {
 	V8_Context* ctx = static_cast<V8_Context*>(context);
 	ISOLATE_SCOPE(ctx->GetIsolate());
 
@@ -376,71 +787,149 @@ char* V8_Context_TryCatch(void* context, void* callback, int simple) {
 		return NULL;
 	}
 
-	String::Utf8Value exception(try_catch.Exception());
-	const char* exception_string = ToCString(exception);
-	Handle<Message> message = try_catch.Message();
+	return V8_TryCatch_Report(try_catch, simple);
+}
 
-	if (message.IsEmpty() || simple) {
-		// V8 didn't provide any extra information about this error; just
-		// print the exception.
-		char *cstr = (char*)malloc(exception.length() + 1);
-		std::strcpy(cstr, exception_string);
-		return cstr;
+// Copies a value's string form into malloc'ed memory. Empty handles
+// give an empty string.
+char* V8_StringCopy(Handle<Value> value) {
+	const char* str = "";
+	String::Utf8Value utf8(value);
+	if (!value.IsEmpty() && *utf8 != NULL) {
+		str = *utf8;
 	}
+	char *cstr = (char*)malloc(strlen(str) + 1);
+	std::strcpy(cstr, str);
+	return cstr;
+}
 
-	std::stringstream report;
+V8_Exception* V8_NewException(V8_Context* context, TryCatch& try_catch) {
+	V8_Exception* exception = (V8_Exception*)calloc(1, sizeof(V8_Exception));
 
-	// Print (filename):(line number): (message).
-	String::Utf8Value filename(message->GetScriptResourceName());
-	const char* filename_string = ToCString(filename);
-	int linenum = message->GetLineNumber();
-	report << filename_string << ":" << linenum << ": " << exception_string << std::endl;
+	exception->exception = new_V8_Value(context, try_catch.Exception());
+	exception->report = V8_TryCatch_Report(try_catch, false);
+	exception->terminated = try_catch.HasTerminated();
 
-	// Print line of source code.
-	String::Utf8Value sourceline(message->GetSourceLine());
-	const char* sourceline_string = ToCString(sourceline);
-	report << sourceline_string << std::endl;
+	// The engine stays usable after the near heap limit hook terminated
+	// the script, like after any other termination.
+	isolate_data* data = V8_IsolateData(context->GetIsolate());
+	if (exception->terminated && data != NULL && data->out_of_memory) {
+		exception->out_of_memory = 1;
+		data->out_of_memory = 0;
+		V8::CancelTerminateExecution(context->GetIsolate());
+	}
 
-	// Print wavy underline (GetUnderline is deprecated).
-	int start = message->GetStartColumn();
-	for (int i = 0; i < start; i++) {
-		report << " ";
+	Handle<Message> message = try_catch.Message();
+
+	if (message.IsEmpty()) {
+		exception->message = V8_StringCopy(try_catch.Exception());
+		exception->resource_name = V8_StringCopy(Handle<Value>());
+		exception->source_line = V8_StringCopy(Handle<Value>());
+		return exception;
 	}
 
-	int end = message->GetEndColumn();
-	for (int i = start; i < end; i++) {
-		report << "^";
+	exception->message = V8_StringCopy(message->Get());
+	exception->resource_name = V8_StringCopy(message->GetScriptResourceName());
+	exception->line = message->GetLineNumber();
+	exception->start_column = message->GetStartColumn();
+	exception->end_column = message->GetEndColumn();
+	exception->source_line = V8_StringCopy(message->GetSourceLine());
+
+	// Only available after SetCaptureStackTraceForUncaughtExceptions.
+	Handle<StackTrace> stack_trace = message->GetStackTrace();
+	if (stack_trace.IsEmpty() || stack_trace->GetFrameCount() == 0) {
+		return exception;
 	}
 
-	report << std::endl;
+	int count = stack_trace->GetFrameCount();
+	exception->frames = (V8_StackFrame*)calloc(count, sizeof(V8_StackFrame));
+	exception->frame_count = count;
+
+	for (int i = 0; i < count; i++) {
+		Handle<StackFrame> frame = stack_trace->GetFrame(i);
+		V8_StackFrame* the_frame = &exception->frames[i];
+		the_frame->function = V8_StringCopy(frame->GetFunctionName());
+		the_frame->script = V8_StringCopy(frame->GetScriptNameOrSourceURL());
+		the_frame->line = frame->GetLineNumber();
+		the_frame->column = frame->GetColumn();
+		the_frame->is_eval = frame->IsEval();
+		the_frame->is_constructor = frame->IsConstructor();
+	}
 
-	String::Utf8Value stack_trace(try_catch.StackTrace());
-	if (stack_trace.length() > 0) {
-		const char* stack_trace_string = ToCString(stack_trace);
-		report << stack_trace_string << std::endl;
+	return exception;
+}
+
+V8_Exception* V8_Context_TryCatchException(void* context, V8_GoHandle callback) {
+	V8_Context* ctx = static_cast<V8_Context*>(context);
+	ISOLATE_SCOPE(ctx->GetIsolate());
+
+	TryCatch try_catch;
+
+	try_catch_callback(callback);
+
+	if (!try_catch.HasCaught()) {
+		return NULL;
 	}
 
-	std::string report_string = report.str();
-	char *cstr = (char*)malloc(report_string.length() +1);
-	std::strcpy(cstr, report_string.c_str());
+	return V8_NewException(ctx, try_catch);
+}
 
-	return cstr;
+void V8_DisposeException(V8_Exception* exception) {
+	for (int i = 0; i < exception->frame_count; i++) {
+		free(exception->frames[i].function);
+		free(exception->frames[i].script);
+	}
+	free(exception->frames);
+	free(exception->message);
+	free(exception->resource_name);
+	free(exception->source_line);
+	free(exception->report);
+	free(exception);
+}
+
+// Can be called from any thread, the isolate needn't be locked.
+void V8_TerminateExecution(void* context) {
+	V8::TerminateExecution(static_cast<V8_Context*>(context)->GetIsolate());
+}
+
+void V8_CancelTerminateExecution(void* context) {
+	V8_Context* ctx = static_cast<V8_Context*>(context);
+	ISOLATE_SCOPE(ctx->GetIsolate());
+
+	V8::CancelTerminateExecution(isolate);
 }
 
 /*
 script
 */
-void* V8_Compile(void* engine, const char* code, int length, void* script_origin,void* script_data) {
+void* V8_Compile(void* engine, const char* code, int length, void* script_origin,void* script_data, V8_Exception** exception) {
 	ENGINE_SCOPE(engine);
 
 	HandleScope handle_scope(isolate);
 
-	Handle<Script> script = Script::New(
-		String::NewFromOneByte(isolate, (uint8_t*)code, String::kNormalString, length),
-		static_cast<ScriptOrigin*>(script_origin),
-		static_cast<ScriptData*>(script_data),
-		Handle<String>()
-	);
+	Handle<String> source = String::NewFromOneByte(isolate, (uint8_t*)code, String::kNormalString, length);
+	Handle<Script> script;
+
+	// the try catch is only set up on request, otherwise the syntax error
+	// must keep reaching the message listeners and any outer try catch.
+	if (exception == NULL) {
+		script = Script::New(source,
+			static_cast<ScriptOrigin*>(script_origin),
+			static_cast<ScriptData*>(script_data),
+			Handle<String>()
+		);
+	} else {
+		TryCatch try_catch;
+
+		script = Script::New(source,
+			static_cast<ScriptOrigin*>(script_origin),
+			static_cast<ScriptData*>(script_data),
+			Handle<String>()
+		);
+
+		if (try_catch.HasCaught())
+			*exception = V8_NewException(the_engine, try_catch);
+	}
 
 	if (script.IsEmpty())
 		return NULL;
@@ -452,13 +941,67 @@ void V8_DisposeScript(void* script) {
 	delete static_cast<V8_Script*>(script);
 }
 
-void* V8_Script_Run(void* script) {
+void* V8_Script_Run(void* script, V8_Exception** exception) {
 	V8_Script* the_script = static_cast<V8_Script*>(script);
 	ISOLATE_SCOPE(the_script->engine->GetIsolate());
 	V8_Context* the_context = V8_Current_Context(isolate);
+	if (the_context == NULL)
+		return NULL;
+
+	Local<Script> local_script = Local<Script>::New(isolate, the_script->self);
+
+	if (exception == NULL)
+		return new_V8_Value(the_context, local_script->Run());
+
+	TryCatch try_catch;
+
+	Handle<Value> result = local_script->Run();
+
+	if (try_catch.HasCaught()) {
+		*exception = V8_NewException(the_context, try_catch);
+		return NULL;
+	}
+
+	return new_V8_Value(the_context, result);
+}
+
+// Runs an unbound script in the given context instead of the current
+// one. The caller is inside a context scope of the same engine.
+// Callbacks of the script see the given context as their scope, like
+// inside V8_Context_Scope.
+void* V8_Script_RunIn(void* script, void* context, V8_GoHandle context_handle, V8_Exception** exception) {
+	V8_Script* the_script = static_cast<V8_Script*>(script);
+	V8_Context* the_context = static_cast<V8_Context*>(context);
+	ISOLATE_SCOPE(the_script->engine->GetIsolate());
+
+	isolate_data* the_data = V8_IsolateData(isolate);
+	scope_data* prev_context = the_data->scope;
+	scope_data data;
+	data.context = context;
+	data.context_handle = context_handle;
+	data.callback_depth = 0;
+	the_data->scope = &data;
+
+	Context::Scope context_scope(Local<Context>::New(isolate, the_context->self));
 	Local<Script> local_script = Local<Script>::New(isolate, the_script->self);
 
-	return new_V8_Value(the_context, local_script->Run());
+	void* result = NULL;
+
+	if (exception == NULL) {
+		result = new_V8_Value(the_context, local_script->Run());
+	} else {
+		TryCatch try_catch;
+
+		Handle<Value> value = local_script->Run();
+
+		if (try_catch.HasCaught())
+			*exception = V8_NewException(the_context, try_catch);
+		else
+			result = new_V8_Value(the_context, value);
+	}
+
+	the_data->scope = prev_context;
+	return result;
 }
 
 /*
@@ -520,6 +1063,11 @@ void V8_DisposeValue(void* value) {
 	delete static_cast<V8_Value*>(value);
 }
 
+void V8_DisposeValues(void** values, int count) {
+	for (int i = 0; i < count; i ++)
+		delete static_cast<V8_Value*>(values[i]);
+}
+
 int V8_Value_IsUndefined(void* value) {
 	VALUE_SCOPE(value);
 	return local_value->IsUndefined();
@@ -688,6 +1236,12 @@ void* V8_NewString(void* context, const char* val, int val_length) {
 	);
 }
 
+void* V8_NewDate(void* context, double val) {
+	CONTEXT_SCOPE(context);
+
+	return new_V8_Value(the_context, Date::New(val));
+}
+
 /*
 object
 */
@@ -697,22 +1251,116 @@ void* V8_NewObject(void* context) {
 	return new_V8_Value(the_context, Object::New());
 }
 
+int V8_Object_GetIdentityHash(void* value) {
+	VALUE_SCOPE(value);
+	return Local<Object>::Cast(local_value)->GetIdentityHash();
+}
+
+int V8_Value_StrictEquals(void* value, void* other) {
+	VALUE_SCOPE(value);
+	return local_value->StrictEquals(static_cast<V8_Value*>(other)->self);
+}
+
 int V8_Object_InternalFieldCount(void* value) {
 	VALUE_SCOPE(value);
 	return Local<Object>::Cast(local_value)->InternalFieldCount();
 }
 
-void* V8_Object_GetInternalField(void* value, int index) {
+// Returns zero when the field doesn't hold a Go handle.
+V8_GoHandle V8_InternalFieldHandle(Handle<Object> obj, int index) {
+	Local<Value> data = obj->GetInternalField(index);
+	if (!data->IsExternal())
+		return 0;
+	return (V8_GoHandle)Local<External>::Cast(data)->Value();
+}
+
+V8_GoHandle V8_Object_GetInternalField(void* value, int index) {
+	VALUE_SCOPE(value);
+	return V8_InternalFieldHandle(Local<Object>::Cast(local_value), index);
+}
+
+V8_GoHandle V8_Object_SetInternalField(void* value, int index, V8_GoHandle data) {
 	VALUE_SCOPE(value);
 	Local<Object> obj = Local<Object>::Cast(local_value);
-	Local<Value> data = obj->GetInternalField(index);
-	return Local<External>::Cast(data)->Value();
+	V8_GoHandle old = V8_InternalFieldHandle(obj, index);
+	obj->SetInternalField(index, External::New((void*)data));
+	return old;
 }
 
-void V8_Object_SetInternalField(void* value, int index, void* data) {
+void* V8_Object_GetAlignedPointerFromInternalField(void* value, int index) {
 	VALUE_SCOPE(value);
 	Local<Object> obj = Local<Object>::Cast(local_value);
-	obj->SetInternalField(index, External::New(data));
+	return obj->GetAlignedPointerFromInternalField(index);
+}
+
+V8_GoHandle V8_Object_SetAlignedPointerInInternalField(void* value, int index, void* pointer) {
+	VALUE_SCOPE(value);
+	Local<Object> obj = Local<Object>::Cast(local_value);
+	V8_GoHandle old = V8_InternalFieldHandle(obj, index);
+	obj->SetAlignedPointerInInternalField(index, pointer);
+	return old;
+}
+
+// The weak handles still waiting for their object to die are linked
+// into the isolate data, so they can be freed with the engine.
+struct V8_WeakHandle {
+	V8_Context*        engine;
+	int                id;
+	Persistent<Object> self;
+	V8_WeakHandle*     prev;
+	V8_WeakHandle*     next;
+};
+
+void V8_UnlinkWeakHandle(Isolate* isolate, V8_WeakHandle* handle) {
+	isolate_data* data = V8_IsolateData(isolate);
+
+	if (handle->prev != NULL)
+		handle->prev->next = handle->next;
+	else
+		data->weak_handles = handle->next;
+
+	if (handle->next != NULL)
+		handle->next->prev = handle->prev;
+}
+
+void V8_WeakCallback(Isolate* isolate, Persistent<Object>* object, V8_WeakHandle* handle) {
+	HandleScope handle_scope(isolate);
+	void* value = new_V8_Value(handle->engine, Local<Object>::New(isolate, *object));
+	int id = handle->id;
+
+	V8_UnlinkWeakHandle(isolate, handle);
+	object->Reset();
+	delete handle;
+
+	go_weak_callback(id, value);
+}
+
+void V8_Object_SetWeak(void* engine, void* value, int id) {
+	VALUE_SCOPE(value);
+	isolate_data* data = V8_IsolateData(isolate);
+
+	V8_WeakHandle* handle = new V8_WeakHandle();
+	handle->engine = static_cast<V8_Context*>(engine);
+	handle->id = id;
+	handle->prev = NULL;
+	handle->next = data->weak_handles;
+	if (handle->next != NULL)
+		handle->next->prev = handle;
+	data->weak_handles = handle;
+
+	handle->self.Reset(isolate, Local<Object>::Cast(local_value));
+	handle->self.MakeWeak(handle, V8_WeakCallback);
+}
+
+void V8_DisposeWeakHandles(Isolate* isolate) {
+	isolate_data* data = V8_IsolateData(isolate);
+
+	while (data->weak_handles != NULL) {
+		V8_WeakHandle* handle = data->weak_handles;
+		data->weak_handles = handle->next;
+		handle->self.Reset();
+		delete handle;
+	}
 }
 
 int V8_Object_SetProperty(void* value, const char* key, int key_length, void* prop_value, int attribs) {
@@ -848,20 +1496,21 @@ void V8_AccessorGetterCallback(Local<String> property, const PropertyCallbackInf
 	Isolate* isolate_ptr = info.GetIsolate();
 	ISOLATE_SCOPE(isolate_ptr);
 
+	if (!V8_CheckCallbackScope(isolate))
+		return;
+
 	Local<Array> callback_data = Local<Array>::Cast(info.Data());
 
 	V8_AccessorCallbackInfo callback_info;
 	callback_info.engine = Local<External>::Cast(callback_data->Get(OTA_Context))->Value();
 	callback_info.info = (void*)&info;
 	callback_info.returnValue = NULL;
-	callback_info.data = Local<External>::Cast(callback_data->Get(OTA_Data))->Value();
-	callback_info.callback = Local<External>::Cast(callback_data->Get(OTA_Getter))->Value();
-	callback_info.key = (const char*)Local<External>::Cast(callback_data->Get(OTA_KeyString))->Value();
-	callback_info.key_length = Local<Integer>::Cast(callback_data->Get(OTA_KeyLength))->Value();
+	callback_info.callback = (V8_GoHandle)Local<External>::Cast(callback_data->Get(OTA_Getter))->Value();
 
-	void* context_ptr = V8_Current_ContextPtr(isolate);
+	V8_GoHandle context_handle = V8_Current_ContextHandle(isolate);
+	GoCallbackScope callback_scope(isolate);
 
-	go_accessor_callback(OTA_Getter, &callback_info, context_ptr);
+	go_accessor_callback(OTA_Getter, &callback_info, context_handle);
 
 	if (callback_info.returnValue != NULL)
 		delete static_cast<V8_ReturnValue*>(callback_info.returnValue);
@@ -871,6 +1520,9 @@ void V8_AccessorSetterCallback(Local<String> property, Local<Value> value, const
 	Isolate* isolate_ptr = info.GetIsolate();
 	ISOLATE_SCOPE(isolate_ptr);
 
+	if (!V8_CheckCallbackScope(isolate))
+		return;
+
 	Local<Array> callback_data = Local<Array>::Cast(info.Data());
 
 	V8_AccessorCallbackInfo callback_info;
@@ -878,37 +1530,32 @@ void V8_AccessorSetterCallback(Local<String> property, Local<Value> value, const
 	callback_info.info = (void*)&info;
 	callback_info.returnValue = NULL;
 	callback_info.setValue = new_V8_Value(static_cast<V8_Context*>(callback_info.engine), value);
-	callback_info.data = Local<External>::Cast(callback_data->Get(OTA_Data))->Value();
-	callback_info.callback = Local<External>::Cast(callback_data->Get(OTA_Setter))->Value();
-	callback_info.key = (const char*)Local<External>::Cast(callback_data->Get(OTA_KeyString))->Value();
-	callback_info.key_length = Local<Integer>::Cast(callback_data->Get(OTA_KeyLength))->Value();
+	callback_info.callback = (V8_GoHandle)Local<External>::Cast(callback_data->Get(OTA_Setter))->Value();
 
-	void* context_ptr = V8_Current_ContextPtr(isolate);
+	V8_GoHandle context_handle = V8_Current_ContextHandle(isolate);
+	GoCallbackScope callback_scope(isolate);
 
-	go_accessor_callback(OTA_Setter, &callback_info, context_ptr);
+	go_accessor_callback(OTA_Setter, &callback_info, context_handle);
 
 	if (callback_info.returnValue != NULL)
 		delete static_cast<V8_ReturnValue*>(callback_info.returnValue);
 }
 
 // sync with V8_ObjectTemplate_SetAccessor
-void V8_Object_SetAccessor(void *value, const char* key, int key_length, void* getter, void* setter, void* data, int attribs) {
+void V8_Object_SetAccessor(void *value, const char* key, int key_length, V8_GoHandle getter, V8_GoHandle setter, int attribs) {
 	VALUE_SCOPE(value);
 
 	Handle<Array> callback_info = Array::New(OTA_Num);
 	callback_info->Set(OTA_Context, External::New((void*)the_value->context));
-	callback_info->Set(OTA_Getter, External::New(getter));
-	callback_info->Set(OTA_Setter, External::New(setter));
-	callback_info->Set(OTA_KeyString, External::New((void*)key));
-	callback_info->Set(OTA_KeyLength, Integer::New(key_length));
-	callback_info->Set(OTA_Data, External::New(data));
+	callback_info->Set(OTA_Getter, External::New((void*)getter));
+	callback_info->Set(OTA_Setter, External::New((void*)setter));
 
 	if (callback_info.IsEmpty())
 		return;
 
 	Local<Object>::Cast(local_value)->SetAccessor(
 		String::NewFromOneByte(isolate, (uint8_t*)key, String::kNormalString, key_length),
-		V8_AccessorGetterCallback, setter == NULL ? NULL : V8_AccessorSetterCallback,
+		V8_AccessorGetterCallback, setter == 0 ? NULL : V8_AccessorSetterCallback,
  		callback_info
 	);
 }
@@ -1150,6 +1797,9 @@ void V8_FunctionCallback(const v8::FunctionCallbackInfo<Value>& info) {
 	Isolate* isolate_ptr = info.GetIsolate();
 	ISOLATE_SCOPE(isolate_ptr);
 
+	if (!V8_CheckCallbackScope(isolate))
+		return;
+
 	Local<Array> callback_data = Local<Array>::Cast(info.Data());
 
 	V8_FunctionCallbackInfo callback_info;
@@ -1157,18 +1807,18 @@ void V8_FunctionCallback(const v8::FunctionCallbackInfo<Value>& info) {
 	callback_info.info = &info;
 	callback_info.returnValue = NULL;
 
-	void* callback = Local<External>::Cast(callback_data->Get(1))->Value();
-	void* data = Local<External>::Cast(callback_data->Get(2))->Value();
+	V8_GoHandle callback = (V8_GoHandle)Local<External>::Cast(callback_data->Get(1))->Value();
 
-	void* context_ptr = V8_Current_ContextPtr(isolate);
+	V8_GoHandle context_handle = V8_Current_ContextHandle(isolate);
+	GoCallbackScope callback_scope(isolate);
 
-	go_function_callback(&callback_info, callback, context_ptr, data);
+	go_function_callback(&callback_info, callback, context_handle);
 
 	if (callback_info.returnValue != NULL)
 		delete callback_info.returnValue;
 }
 
-void* V8_Function_Call(void* value, int argc, void* argv) {
+void* V8_Function_Call(void* value, int argc, void* argv, V8_Exception** exception) {
 	VALUE_SCOPE(value);
 
 	Handle<Value>* real_argv = new Handle<Value>[argc];
@@ -1178,9 +1828,22 @@ void* V8_Function_Call(void* value, int argc, void* argv) {
 		real_argv[i] = Local<Value>::New(isolate, static_cast<V8_Value*>(argv_ptr[i])->self);
 	}
 
-	void* result = new_V8_Value(the_value->context,
-		Local<Function>::Cast(local_value)->Call(local_value, argc, real_argv)
-	);
+	void* result = NULL;
+
+	if (exception == NULL) {
+		result = new_V8_Value(the_value->context,
+			Local<Function>::Cast(local_value)->Call(local_value, argc, real_argv)
+		);
+	} else {
+		TryCatch try_catch;
+
+		Handle<Value> ret = Local<Function>::Cast(local_value)->Call(local_value, argc, real_argv);
+
+		if (try_catch.HasCaught())
+			*exception = V8_NewException(the_value->context, try_catch);
+		else
+			result = new_V8_Value(the_value->context, ret);
+	}
 
 	delete[] real_argv;
 
@@ -1257,27 +1920,26 @@ void V8_ObjectTemplate_SetProperty(void* tpl, const char* key, int key_length, v
 void* V8_ObjectTemplate_NewObject(void* tpl) {
 	OBJECT_TEMPLATE_SCOPE(tpl);
 	V8_Context* the_context = V8_Current_Context(isolate);
+	if (the_context == NULL)
+		return NULL;
 	return new_V8_Value(the_context, local_template->NewInstance());
 }
 
 // sync with V8_Object_SetAccessor
-void V8_ObjectTemplate_SetAccessor(void *tpl, const char* key, int key_length, void* getter, void* setter, void* data, int attribs) {
+void V8_ObjectTemplate_SetAccessor(void *tpl, const char* key, int key_length, V8_GoHandle getter, V8_GoHandle setter, int attribs) {
 	OBJECT_TEMPLATE_HANDLE_SCOPE(tpl);
 
-	Handle<Array> callback_info = Array::New(5);
-	callback_info->Set(0, External::New((void*)the_template->engine));
-	callback_info->Set(1, External::New(getter));
-	callback_info->Set(2, External::New(setter));
-	callback_info->Set(3, External::New((void*)key));
-	callback_info->Set(4, Integer::New(key_length));
-	callback_info->Set(5, External::New(data));
+	Handle<Array> callback_info = Array::New(OTA_Num);
+	callback_info->Set(OTA_Context, External::New((void*)the_template->engine));
+	callback_info->Set(OTA_Getter, External::New((void*)getter));
+	callback_info->Set(OTA_Setter, External::New((void*)setter));
 
 	if (callback_info.IsEmpty())
 		return;
 
 	local_template->SetAccessor(
 		String::NewFromOneByte(isolate, (uint8_t*)key, String::kNormalString, key_length),
-		V8_AccessorGetterCallback, setter == NULL ? NULL : V8_AccessorSetterCallback,
+		V8_AccessorGetterCallback, setter == 0 ? NULL : V8_AccessorSetterCallback,
  		callback_info
 	);
 }
@@ -1291,13 +1953,15 @@ void V8_NamedPropertyGetterCallbackBase(
 	Local<Value> callback_data_val
 ) {
     ISOLATE_SCOPE(isolate_ptr);
+
+    if (!V8_CheckCallbackScope(isolate))
+        return;
     Local<Array> callback_data = Local<Array>::Cast(callback_data_val);
     V8_PropertyCallbackInfo callback_info;
     callback_info.engine = Local<External>::Cast(callback_data->Get(OTP_Context))->Value();
     callback_info.info = info_ptr;
     callback_info.returnValue = NULL;
-    callback_info.data = Local<External>::Cast(callback_data->Get(OTP_Data))->Value();
-    callback_info.callback = Local<External>::Cast(callback_data->Get(typ))->Value();
+    callback_info.callback = (V8_GoHandle)Local<External>::Cast(callback_data->Get(typ))->Value();
     callback_info.key = NULL;
 
 	if (typ != OTP_Enumerator) {
@@ -1313,9 +1977,10 @@ void V8_NamedPropertyGetterCallbackBase(
 		);
 	}
 
-	void* context_ptr = V8_Current_ContextPtr(isolate);
+	V8_GoHandle context_handle = V8_Current_ContextHandle(isolate);
+	GoCallbackScope callback_scope(isolate);
 
-	go_named_property_callback(typ, &callback_info, context_ptr);
+	go_named_property_callback(typ, &callback_info, context_handle);
 
 	if (typ != OTP_Enumerator) {
 		free(callback_info.key);
@@ -1347,33 +2012,31 @@ void V8_NamedPropertyEnumeratorCallback(const PropertyCallbackInfo<Array> &info)
 
 void V8_ObjectTemplate_SetNamedPropertyHandler(
 	void* tpl, 
-	void* getter, 
-	void* setter, 
-	void* query, 
-	void* deleter, 
-	void* enumerator, 
-	void* data
+	V8_GoHandle getter, 
+	V8_GoHandle setter, 
+	V8_GoHandle query, 
+	V8_GoHandle deleter, 
+	V8_GoHandle enumerator
 ) {
 	OBJECT_TEMPLATE_HANDLE_SCOPE(tpl);
 
 	Handle<Array> callback_info = Array::New(OTP_Num);
 	callback_info->Set(OTP_Context, External::New((void*)the_template->engine));
-	callback_info->Set(OTP_Getter, External::New(getter));
-	callback_info->Set(OTP_Setter, External::New(setter));
-	callback_info->Set(OTP_Query, External::New(query));
-	callback_info->Set(OTP_Deleter, External::New(deleter));
-	callback_info->Set(OTP_Enumerator, External::New(enumerator));
-	callback_info->Set(OTP_Data, External::New(data));
+	callback_info->Set(OTP_Getter, External::New((void*)getter));
+	callback_info->Set(OTP_Setter, External::New((void*)setter));
+	callback_info->Set(OTP_Query, External::New((void*)query));
+	callback_info->Set(OTP_Deleter, External::New((void*)deleter));
+	callback_info->Set(OTP_Enumerator, External::New((void*)enumerator));
 
 	if (callback_info.IsEmpty())
 		return;
 
 	local_template->SetNamedPropertyHandler(
 		V8_NamedPropertyGetterCallback, 
-		setter == NULL ? NULL : V8_NamedPropertySetterCallback,
-		query == NULL ? NULL : V8_NamedPropertyQueryCallback,
-		deleter == NULL ? NULL : V8_NamedPropertyDeleterCallback,
-		enumerator == NULL ? NULL : V8_NamedPropertyEnumeratorCallback,
+		setter == 0 ? NULL : V8_NamedPropertySetterCallback,
+		query == 0 ? NULL : V8_NamedPropertyQueryCallback,
+		deleter == 0 ? NULL : V8_NamedPropertyDeleterCallback,
+		enumerator == 0 ? NULL : V8_NamedPropertyEnumeratorCallback,
  		callback_info
 	);
 }
@@ -1388,13 +2051,15 @@ void V8_IndexedPropertyGetterCallbackBase(
 ) {
     ISOLATE_SCOPE(isolate_ptr);
 
+    if (!V8_CheckCallbackScope(isolate))
+        return;
+
     Local<Array> callback_data = Local<Array>::Cast(callback_data_val);
     V8_PropertyCallbackInfo callback_info;
     callback_info.engine = Local<External>::Cast(callback_data->Get(OTP_Context))->Value();
     callback_info.info = info_ptr;
     callback_info.returnValue = NULL;
-    callback_info.data = Local<External>::Cast(callback_data->Get(OTP_Data))->Value();
-    callback_info.callback = Local<External>::Cast(callback_data->Get(typ))->Value();
+    callback_info.callback = (V8_GoHandle)Local<External>::Cast(callback_data->Get(typ))->Value();
 	callback_info.index = index;
 
 	if (typ == OTP_Setter) {
@@ -1404,9 +2069,10 @@ void V8_IndexedPropertyGetterCallbackBase(
 		);
 	}
 
-	void* context_ptr = V8_Current_ContextPtr(isolate);
+	V8_GoHandle context_handle = V8_Current_ContextHandle(isolate);
+	GoCallbackScope callback_scope(isolate);
 
-	go_indexed_property_callback(typ, &callback_info, context_ptr);
+	go_indexed_property_callback(typ, &callback_info, context_handle);
 
 	if (callback_info.returnValue != NULL)
 		delete static_cast<V8_ReturnValue*>(callback_info.returnValue);
@@ -1434,33 +2100,31 @@ void V8_IndexedPropertyEnumeratorCallback(const PropertyCallbackInfo<Array> &inf
 
 void V8_ObjectTemplate_SetIndexedPropertyHandler(
 	void* tpl, 
-	void* getter, 
-	void* setter, 
-	void* query, 
-	void* deleter, 
-	void* enumerator, 
-	void* data
+	V8_GoHandle getter, 
+	V8_GoHandle setter, 
+	V8_GoHandle query, 
+	V8_GoHandle deleter, 
+	V8_GoHandle enumerator
 ) {
 	OBJECT_TEMPLATE_HANDLE_SCOPE(tpl);
 	
 	Handle<Array> callback_info = Array::New(OTP_Num);
 	callback_info->Set(OTP_Context, External::New((void*)the_template->engine));
-	callback_info->Set(OTP_Getter, External::New(getter));
-	callback_info->Set(OTP_Setter, External::New(setter));
-	callback_info->Set(OTP_Query, External::New(query));
-	callback_info->Set(OTP_Deleter, External::New(deleter));
-	callback_info->Set(OTP_Enumerator, External::New(enumerator));
-	callback_info->Set(OTP_Data, External::New(data));
+	callback_info->Set(OTP_Getter, External::New((void*)getter));
+	callback_info->Set(OTP_Setter, External::New((void*)setter));
+	callback_info->Set(OTP_Query, External::New((void*)query));
+	callback_info->Set(OTP_Deleter, External::New((void*)deleter));
+	callback_info->Set(OTP_Enumerator, External::New((void*)enumerator));
 
 	if (callback_info.IsEmpty())
 		return;
 
 	local_template->SetIndexedPropertyHandler(
 		V8_IndexedPropertyGetterCallback, 
-		setter == NULL ? NULL : V8_IndexedPropertySetterCallback,
-		query == NULL ? NULL : V8_IndexedPropertyQueryCallback,
-		deleter == NULL ? NULL : V8_IndexedPropertyDeleterCallback,
-		enumerator == NULL ? NULL : V8_IndexedPropertyEnumeratorCallback,
+		setter == 0 ? NULL : V8_IndexedPropertySetterCallback,
+		query == 0 ? NULL : V8_IndexedPropertyQueryCallback,
+		deleter == 0 ? NULL : V8_IndexedPropertyDeleterCallback,
+		enumerator == 0 ? NULL : V8_IndexedPropertyEnumeratorCallback,
  		callback_info
 	);
 }
@@ -1474,21 +2138,20 @@ void V8_ObjectTemplate_SetInternalFieldCount(void* tpl, int count) {
 /*
 function template
 */
-void* V8_NewFunctionTemplate(void* engine, void* callback, void* data) {
+void* V8_NewFunctionTemplate(void* engine, V8_GoHandle callback) {
 	ENGINE_SCOPE(engine);
 
 	HandleScope scope(isolate);
 
-	Handle<Array> callback_data = Array::New(3);
+	Handle<Array> callback_data = Array::New(2);
 
 	if (callback_data.IsEmpty())
 		return NULL;
 
 	callback_data->Set(0, External::New(engine));
-	callback_data->Set(1, External::New(callback));
-	callback_data->Set(2, External::New(data));
+	callback_data->Set(1, External::New((void*)callback));
 
-	Handle<FunctionTemplate> tpl = callback == NULL ? FunctionTemplate::New() : FunctionTemplate::New(
+	Handle<FunctionTemplate> tpl = callback == 0 ? FunctionTemplate::New() : FunctionTemplate::New(
 		V8_FunctionCallback, callback_data
 	);
 
@@ -1505,6 +2168,8 @@ void V8_DisposeFunctionTemplate(void* tpl) {
 void* V8_FunctionTemplate_GetFunction(void* tpl) {
 	FUNCTION_TEMPLATE_SCOPE(tpl);
 	V8_Context* the_context = V8_Current_Context(isolate);
+	if (the_context == NULL)
+		return NULL;
 	return new_V8_Value(the_context, local_template->GetFunction());
 }
 
@@ -1528,16 +2193,24 @@ void V8_SetFlagsFromString(const char* str, int length) {
 	V8::SetFlagsFromString(str, length);
 }
 
+// The engine of the isolate the thread is in, so global callbacks can
+// report to it. Zero when there is none.
+int V8_CurrentEngineId() {
+	Isolate* isolate = Isolate::GetCurrent();
+	isolate_data* data = isolate == NULL ? NULL : V8_IsolateData(isolate);
+	return data == NULL ? 0 : data->engine_id;
+}
+
 class GoArrayBufferAllocator : public ArrayBuffer::Allocator {
 	public:
 	GoArrayBufferAllocator() {
-		mAc = NULL;
-		mFc = NULL;
+		mAc = 0;
+		mFc = 0;
 	}
 
 	virtual void* Allocate(size_t length) {
-		if(mAc != NULL) {
-			return go_array_buffer_allocate(mAc, length, true); 
+		if(mAc != 0) {
+			return go_array_buffer_allocate(mAc, length, true, V8_CurrentEngineId());
 		}
 
 		void* result = malloc(length);
@@ -1546,31 +2219,31 @@ class GoArrayBufferAllocator : public ArrayBuffer::Allocator {
 	}
 
 	virtual void* AllocateUninitialized(size_t length) {
-		if(mAc != NULL) {
-			return go_array_buffer_allocate(mAc, length, false);
+		if(mAc != 0) {
+			return go_array_buffer_allocate(mAc, length, false, V8_CurrentEngineId());
 		}
 		return malloc(length);
 	}
 
 	virtual void Free(void* data, size_t length) {
-		if(mFc != NULL) {
-			go_array_buffer_free(mFc, data, length);
+		if(mFc != 0) {
+			go_array_buffer_free(mFc, data, length, V8_CurrentEngineId());
 			return;
 		}
 		free(data); 
 	}
 
-	void SetCallback(void* aAc, void* aFc) {
+	void SetCallback(V8_GoHandle aAc, V8_GoHandle aFc) {
 		mAc = aAc;
 		mFc = aFc;
 	}
 
 	private:
-	void* mAc;
-	void* mFc;
+	V8_GoHandle mAc;
+	V8_GoHandle mFc;
 };
 
-void* V8_SetArrayBufferAllocator(void* raw, void* ac, void* fc) {
+void* V8_SetArrayBufferAllocator(void* raw, V8_GoHandle ac, V8_GoHandle fc) {
 	GoArrayBufferAllocator* allocator = static_cast<GoArrayBufferAllocator*>(raw);
 	if(allocator == NULL) {
 		allocator = new GoArrayBufferAllocator();
@@ -1591,24 +2264,22 @@ void V8_Dispose_Allocator(void* raw) {
 // FIXME: Memory leak or not?
 void V8_MessageCallback(Handle< Message > message, Handle< Value > error) {
 	Handle<Array> args = Handle<Array>::Cast(error);
-	void* callback = Handle<External>::Cast(args->Get(0))->Value();
-	void* data = Handle<External>::Cast(args->Get(1))->Value();
-	bool simple = args->Get(2)->BooleanValue();
+	V8_GoHandle callback = (V8_GoHandle)Handle<External>::Cast(args->Get(0))->Value();
+	bool simple = args->Get(1)->BooleanValue();
 	Handle<Value> exception = message->Get();
 	const char* cmessage = V8_Message_ToString(message, exception, simple);	
-	go_message_callback((void*)cmessage, callback, data);
+	go_message_callback((void*)cmessage, callback, V8_CurrentEngineId());
 }
 
-void V8_AddMessageListener(void* callback, void* data, int simple) {
-	if(callback == NULL) {
+void V8_AddMessageListener(V8_GoHandle callback, int simple) {
+	if(callback == 0) {
 		V8::RemoveMessageListeners(V8_MessageCallback);
 		return;
 	}
 
-	Handle<Array> args = Array::New(3);
-	args->Set(0, External::New(callback));
-	args->Set(1, External::New(data));
-	args->Set(2, Boolean::New(simple));
+	Handle<Array> args = Array::New(2);
+	args->Set(0, External::New((void*)callback));
+	args->Set(1, Boolean::New(simple));
 	V8::AddMessageListener(V8_MessageCallback, args);
 }
 
@@ -1616,4 +2287,123 @@ void V8_SetCaptureStackTraceForUncaughtExceptions(int capture, int frame_limit)
 	V8::SetCaptureStackTraceForUncaughtExceptions(capture, frame_limit);	
 }
 
+/*
+cpu profiler
+*/
+void V8_StartCpuProfiling(void* engine, const char* title, int title_length) {
+	ENGINE_SCOPE(engine);
+	HandleScope handle_scope(isolate);
+
+	isolate->GetCpuProfiler()->StartCpuProfiling(
+		String::NewFromUtf8(isolate, title, String::kNormalString, title_length), true
+	);
+}
+
+// Flattens the tree in pre-order, every node refers to its parent.
+void V8_FlattenCpuProfileNode(const CpuProfileNode* node, int parent, std::vector<V8_CpuProfileNode>& nodes) {
+	V8_CpuProfileNode the_node;
+
+	the_node.function_name = V8_StringCopy(node->GetFunctionName());
+	the_node.script_name = V8_StringCopy(node->GetScriptResourceName());
+	the_node.script_id = node->GetScriptId();
+	the_node.line = node->GetLineNumber();
+	the_node.column = node->GetColumnNumber();
+	the_node.hit_count = node->GetHitCount();
+	the_node.id = node->GetNodeId();
+	the_node.parent = parent;
+
+	int index = nodes.size();
+	nodes.push_back(the_node);
+
+	for (int i = 0; i < node->GetChildrenCount(); i++) {
+		V8_FlattenCpuProfileNode(node->GetChild(i), index, nodes);
+	}
+}
+
+V8_CpuProfile* V8_StopCpuProfiling(void* engine, const char* title, int title_length) {
+	ENGINE_SCOPE(engine);
+	HandleScope handle_scope(isolate);
+
+	const CpuProfile* profile = isolate->GetCpuProfiler()->StopCpuProfiling(
+		String::NewFromUtf8(isolate, title, String::kNormalString, title_length)
+	);
+
+	if (profile == NULL)
+		return NULL;
+
+	std::vector<V8_CpuProfileNode> nodes;
+	V8_FlattenCpuProfileNode(profile->GetTopDownRoot(), -1, nodes);
+
+	V8_CpuProfile* result = (V8_CpuProfile*)calloc(1, sizeof(V8_CpuProfile));
+
+	result->title = V8_StringCopy(profile->GetTitle());
+	result->start_time = profile->GetStartTime();
+	result->end_time = profile->GetEndTime();
+
+	result->node_count = nodes.size();
+	result->nodes = (V8_CpuProfileNode*)calloc(nodes.size(), sizeof(V8_CpuProfileNode));
+	std::copy(nodes.begin(), nodes.end(), result->nodes);
+
+	result->sample_count = profile->GetSamplesCount();
+	if (result->sample_count > 0) {
+		result->samples = (unsigned*)calloc(result->sample_count, sizeof(unsigned));
+		for (int i = 0; i < result->sample_count; i++) {
+			result->samples[i] = profile->GetSample(i)->GetNodeId();
+		}
+	}
+
+	const_cast<CpuProfile*>(profile)->Delete();
+
+	return result;
+}
+
+void V8_DisposeCpuProfile(V8_CpuProfile* profile) {
+	for (int i = 0; i < profile->node_count; i++) {
+		free(profile->nodes[i].function_name);
+		free(profile->nodes[i].script_name);
+	}
+	free(profile->nodes);
+	free(profile->samples);
+	free(profile->title);
+	free(profile);
+}
+
+/*
+heap profiler
+*/
+class V8_OutputStream : public OutputStream {
+public:
+	V8_OutputStream(V8_GoHandle writer) : writer_(writer) {
+	}
+
+	void EndOfStream() {
+	}
+
+	WriteResult WriteAsciiChunk(char* data, int size) {
+		return go_output_stream_write(writer_, data, size) ? kContinue : kAbort;
+	}
+
+private:
+	V8_GoHandle writer_;
+};
+
+int V8_TakeHeapSnapshot(void* engine, V8_GoHandle writer) {
+	ENGINE_SCOPE(engine);
+	HandleScope handle_scope(isolate);
+
+	const HeapSnapshot* snapshot = isolate->GetHeapProfiler()->TakeHeapSnapshot(
+		String::NewFromUtf8(isolate, "")
+	);
+
+	if (snapshot == NULL)
+		return 0;
+
+	V8_OutputStream stream(writer);
+	snapshot->Serialize(&stream, HeapSnapshot::kJSON);
+
+	const_cast<HeapSnapshot*>(snapshot)->Delete();
+
+	return 1;
+}
+
 } // extern "C"
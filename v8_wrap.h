@@ -8,6 +8,10 @@
 extern "C" {
 #endif
 
+// C must not keep Go pointers, so it refers to Go values by handles
+// registered on the Go side.
+typedef uintptr_t V8_GoHandle;
+
 typedef enum {
         OTP_Context = 0,
         OTP_Getter,
@@ -15,7 +19,6 @@ typedef enum {
         OTP_Query,
         OTP_Deleter,
         OTP_Enumerator,
-        OTP_Data,
         OTP_Num
 } PropertyDataEnum;
 
@@ -23,9 +26,6 @@ typedef enum {
         OTA_Context = 0,
         OTA_Getter,
         OTA_Setter,
-        OTA_KeyString,
-        OTA_KeyLength,
-        OTA_Data,
         OTA_Num
 } AccessorDataEnum;
 
@@ -33,24 +33,90 @@ typedef struct {
         void*        engine;
         void*        info;
         void*        setValue;
-        const char*  key;
-        int          key_length;
-        void*        data;
-        void*        callback;
+        V8_GoHandle  callback;
         void*        returnValue;
 } V8_AccessorCallbackInfo;
 
 typedef struct {
-        void*     engine;
-        void*     info;
-        void*     callback;
-        void*     setValue;
-        void*     data;
-        char*	  key;
-	uint32_t  index;
-        void*     returnValue;
+        void*       engine;
+        void*       info;
+        V8_GoHandle callback;
+        void*       setValue;
+        char*	    key;
+	uint32_t    index;
+        void*       returnValue;
 } V8_PropertyCallbackInfo;
 
+typedef enum {
+        ET_Error = 0,
+        ET_TypeError,
+        ET_RangeError,
+        ET_SyntaxError,
+        ET_ReferenceError
+} ErrorTypeEnum;
+
+typedef struct {
+        char*  function;
+        char*  script;
+        int    line;
+        int    column;
+        int    is_eval;
+        int    is_constructor;
+} V8_StackFrame;
+
+typedef struct {
+        void*          exception;
+        char*          message;
+        char*          resource_name;
+        int            line;
+        int            start_column;
+        int            end_column;
+        char*          source_line;
+        V8_StackFrame* frames;
+        int            frame_count;
+        char*          report;
+        int            terminated;
+        int            out_of_memory;
+} V8_Exception;
+
+typedef struct {
+        int max_young_space;
+        int max_old_space;
+        int max_executable;
+        int stack_limit;
+        int engine_id;
+        int near_heap_limit;
+} V8_EngineOptions;
+
+typedef struct {
+        size_t total_heap_size;
+        size_t total_heap_size_executable;
+        size_t total_physical_size;
+        size_t used_heap_size;
+        size_t heap_size_limit;
+} V8_HeapStatistics;
+
+typedef struct {
+        char*    function_name;
+        char*    script_name;
+        int      script_id;
+        int      line;
+        int      column;
+        unsigned hit_count;
+        unsigned id;
+        int      parent;
+} V8_CpuProfileNode;
+
+typedef struct {
+        char*              title;
+        int64_t            start_time;
+        int64_t            end_time;
+        V8_CpuProfileNode* nodes;
+        int                node_count;
+        unsigned*          samples;
+        int                sample_count;
+} V8_CpuProfile;
+
 /*
 V8
 */
@@ -58,21 +124,31 @@ extern const char* V8_GetVersion();
 
 extern void V8_SetFlagsFromString(const char* str, int length);
 
-extern void* V8_SetArrayBufferAllocator(void* raw, void* ac, void* fc);
+extern void* V8_SetArrayBufferAllocator(void* raw, V8_GoHandle ac, V8_GoHandle fc);
 
 extern void V8_Dispose_Allocator(void* raw);
 
-extern void V8_AddMessageListener(void* callback, void* data, int simple);
+extern void V8_AddMessageListener(V8_GoHandle callback, int simple);
 
 extern void V8_SetCaptureStackTraceForUncaughtExceptions(int capture, int frame_limit);
 
 /*
 engine
 */
-extern void* V8_NewEngine();
+extern void* V8_NewEngine(V8_EngineOptions* options);
 
 extern void V8_DisposeEngine(void* engine);
 
+extern void V8_Engine_LowMemoryNotification(void* engine);
+
+extern void V8_Engine_DisposeHandles(void* engine, void** values, int value_count, void** scripts, int script_count, void** contexts, int context_count);
+
+extern void V8_Engine_HeapStatistics(void* engine, V8_HeapStatistics* stats);
+
+extern const char* V8_Engine_TakeAPIError(void* engine);
+
+extern int V8_IsDead(void* context);
+
 extern void* V8_ParseJSON(void* context, const char* json, int json_length);
 
 /*
@@ -82,26 +158,48 @@ extern void* V8_NewContext(void* engine, void* global_template);
 
 extern void V8_DisposeContext(void* context);
 
-extern void V8_Context_Enter(void* context);
+extern void* V8_Context_Enter(void* context, V8_GoHandle context_handle);
+
+extern int V8_Context_EnteredByThread(void* scope);
+
+extern void V8_Context_Exit(void* scope);
+
+extern void V8_Context_Unlocked(void* context, V8_GoHandle callback);
 
-extern void V8_Context_Exit(void* context);
+extern int V8_IsLockedByThread(void* engine);
 
-extern void V8_Context_Scope(void* context, void* context_ptr, void* callback);
+extern void V8_Context_Scope(void* context, V8_GoHandle context_handle, V8_GoHandle callback);
+
+extern void V8_HandleScope(void* context, V8_GoHandle callback);
+
+extern void V8_HandleScope_Escape(void* scope, void* value);
 
 extern void* V8_Context_Global(void* context);
 
-extern void V8_Context_ThrowException(void* context, const char* err, int err_length);
+extern void V8_Context_ThrowException(void* context, void* value);
+
+extern void* V8_Context_NewError(void* context, const char* message, int message_length, ErrorTypeEnum type);
+
+extern char* V8_Context_TryCatch(void* context, V8_GoHandle callback, int simple);
+
+extern V8_Exception* V8_Context_TryCatchException(void* context, V8_GoHandle callback);
+
+extern void V8_DisposeException(V8_Exception* exception);
 
-extern char* V8_Context_TryCatch(void* context, void* callback, int simple);
+extern void V8_TerminateExecution(void* context);
+
+extern void V8_CancelTerminateExecution(void* context);
 
 /*
 script
 */
-extern void* V8_Compile(void* engine, const char* code, int length, void* script_origin, void* script_data);
+extern void* V8_Compile(void* engine, const char* code, int length, void* script_origin, void* script_data, V8_Exception** exception);
 
 extern void V8_DisposeScript(void* script);
 
-extern void* V8_Script_Run(void* script);
+extern void* V8_Script_Run(void* script, V8_Exception** exception);
+
+extern void* V8_Script_RunIn(void* script, void* context, V8_GoHandle context_handle, V8_Exception** exception);
 
 /*
 script data
@@ -130,6 +228,8 @@ value
 */
 extern void V8_DisposeValue(void* value);
 
+extern void V8_DisposeValues(void** values, int count);
+
 extern int V8_Value_IsUndefined(void* value);
 
 extern int V8_Value_IsNull(void* value);
@@ -192,6 +292,8 @@ extern void* V8_NewNumber(void* context, double val);
 
 extern void* V8_NewString(void* context, const char* val, int val_length);
 
+extern void* V8_NewDate(void* context, double val);
+
 extern void* V8_NewExternal(void* context, void* data);
 
 /*
@@ -229,13 +331,23 @@ extern void* V8_Object_GetPrototype(void *value);
 
 extern int V8_Object_SetPrototype(void *value, void *proto);
 
-extern void V8_Object_SetAccessor(void *value, const char* key, int key_length, void* getter, void* setter, void* data, int attribs);
+extern void V8_Object_SetAccessor(void *value, const char* key, int key_length, V8_GoHandle getter, V8_GoHandle setter, int attribs);
+
+extern int V8_Object_GetIdentityHash(void* value);
+
+extern int V8_Value_StrictEquals(void* value, void* other);
 
 extern int V8_Object_InternalFieldCount(void* value);
 
-extern void* V8_Object_GetInternalField(void* value, int index);
+extern V8_GoHandle V8_Object_GetInternalField(void* value, int index);
 
-extern void V8_Object_SetInternalField(void* value, int index, void* data);
+extern V8_GoHandle V8_Object_SetInternalField(void* value, int index, V8_GoHandle data);
+
+extern void* V8_Object_GetAlignedPointerFromInternalField(void* value, int index);
+
+extern V8_GoHandle V8_Object_SetAlignedPointerInInternalField(void* value, int index, void* pointer);
+
+extern void V8_Object_SetWeak(void* engine, void* value, int id);
 
 extern void* V8_AccessorCallbackInfo_This(void *info, AccessorDataEnum type);
 
@@ -288,7 +400,7 @@ extern void V8_ReturnValue_SetUndefined(void* rv);
 /*
 function
 */
-extern void* V8_Function_Call(void* value, int argc, void* argv);
+extern void* V8_Function_Call(void* value, int argc, void* argv, V8_Exception** exception);
 
 extern void* V8_FunctionCallbackInfo_Get(void* info, int i);
 
@@ -313,26 +425,24 @@ extern void V8_ObjectTemplate_SetProperty(void* tpl, const char* key, int key_le
 
 extern void* V8_ObjectTemplate_NewObject(void* tpl);
 
-extern void V8_ObjectTemplate_SetAccessor(void *tpl, const char* key, int key_length, void* getter, void* setter, void* data, int attribs);
+extern void V8_ObjectTemplate_SetAccessor(void *tpl, const char* key, int key_length, V8_GoHandle getter, V8_GoHandle setter, int attribs);
 
 extern void V8_ObjectTemplate_SetNamedPropertyHandler(
         void* tpl, 
-        void* getter, 
-        void* setter, 
-        void* query, 
-        void* deleter, 
-        void* enumerator, 
-        void* data
+        V8_GoHandle getter, 
+        V8_GoHandle setter, 
+        V8_GoHandle query, 
+        V8_GoHandle deleter, 
+        V8_GoHandle enumerator
 );
 
 extern void V8_ObjectTemplate_SetIndexedPropertyHandler(
         void* tpl, 
-        void* getter, 
-        void* setter, 
-        void* query, 
-        void* deleter, 
-        void* enumerator, 
-        void* data
+        V8_GoHandle getter, 
+        V8_GoHandle setter, 
+        V8_GoHandle query, 
+        V8_GoHandle deleter, 
+        V8_GoHandle enumerator
 );
 
 extern void V8_ObjectTemplate_SetInternalFieldCount(void *tpl, int count);
@@ -340,7 +450,7 @@ extern void V8_ObjectTemplate_SetInternalFieldCount(void *tpl, int count);
 /*
 function template
 */
-extern void* V8_NewFunctionTemplate(void* engine, void* callback, void* data);
+extern void* V8_NewFunctionTemplate(void* engine, V8_GoHandle callback);
 
 extern void V8_DisposeFunctionTemplate(void* tpl);
 
@@ -350,6 +460,20 @@ extern void V8_FunctionTemplate_SetClassName(void* tpl, const char* name, int na
 
 extern void* V8_FunctionTemplate_InstanceTemplate(void* tpl);
 
+/*
+cpu profiler
+*/
+extern void V8_StartCpuProfiling(void* engine, const char* title, int title_length);
+
+extern V8_CpuProfile* V8_StopCpuProfiling(void* engine, const char* title, int title_length);
+
+extern void V8_DisposeCpuProfile(V8_CpuProfile* profile);
+
+/*
+heap profiler
+*/
+extern int V8_TakeHeapSnapshot(void* engine, V8_GoHandle writer);
+
 #ifdef __cplusplus
 } // extern "C"
 #endif